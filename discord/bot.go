@@ -1,45 +1,94 @@
 package discord
 
 import (
-	"bytes"
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
+	"runtime"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 
 	"github.com/aita/ghost/shell"
 )
 
-type Bot struct {
-	sh      *shell.Shell
-	session *discordgo.Session
-	option  BotOption
+// defaultMaxMessages is the default of BotOption.MaxMessages.
+const defaultMaxMessages = 3
 
-	mu sync.Mutex
+type Bot struct {
+	sessions *sessionManager
+	pool     *pool
+	session  *discordgo.Session
+	option   BotOption
+
+	// ctx is cancelled by Close to abort the running scripts.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type BotOption struct {
 	Prefix string
+
+	// Scope tells which messages share a shell session. It defaults to
+	// ScopeChannel.
+	Scope SessionScope
+	// IdleTimeout is how long a session is kept after its last message.
+	// Sessions are kept forever if it is 0.
+	IdleTimeout time.Duration
+	// Workers is the number of scripts which can run at the same time,
+	// each in a different session. It defaults to the number of CPUs.
+	Workers int
+	// Timeout aborts a script which runs longer. Scripts never time out
+	// if it is 0.
+	Timeout time.Duration
+	// Limits bounds the resources which each script can use. The storage
+	// limit also bounds the universal variables of each guild, separately.
+	Limits shell.Limits
+	// MaxMessages is the number of messages which the output of a script
+	// can be split into. Longer output is sent as a file. It defaults to
+	// 3.
+	MaxMessages int
+
+	// Storage returns the storage which keeps the universal variables of
+	// a namespace across restarts if not nil. A namespace is a guild, or
+	// a channel of direct messages, and its name is safe to use in a file
+	// name.
+	Storage func(namespace string) shell.Storage
+	// Readonly are the universal variables pinned by the operator in every
+	// namespace, such as a greeting, which scripts cannot change.
+	Readonly map[string]string
 }
 
 func NewBot(token string, option BotOption) (bot *Bot, err error) {
-	sh := &shell.Shell{
-		In:  bytes.NewReader(nil),
-		Out: bytes.NewBuffer(nil),
+	if option.Scope == "" {
+		option.Scope = ScopeChannel
+	}
+	if !option.Scope.valid() {
+		err = fmt.Errorf("unknown session scope %q", option.Scope)
+		return
+	}
+	if option.Workers <= 0 {
+		option.Workers = runtime.NumCPU()
+	}
+	if option.MaxMessages <= 0 {
+		option.MaxMessages = defaultMaxMessages
 	}
-	sh.Init()
+	sessions := newSessionManager(option.IdleTimeout, option.Storage, option.Limits, option.Readonly)
 
 	session, err := discordgo.New("Bot " + token)
 	if err != nil {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	bot = &Bot{
-		sh:      sh,
-		session: session,
-		option:  option,
+		sessions: sessions,
+		pool:     newPool(option.Workers),
+		session:  session,
+		option:   option,
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 	bot.session.AddHandler(bot.OnMessageCreate)
 
@@ -51,8 +100,13 @@ func (bot *Bot) Start() error {
 
 }
 
+// Close disconnects from Discord, and aborts the running scripts and waits
+// for them.
 func (bot *Bot) Close() error {
-	return bot.session.Close()
+	err := bot.session.Close()
+	bot.cancel()
+	bot.pool.Close()
+	return err
 }
 
 func (bot *Bot) OnMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -65,20 +119,40 @@ func (bot *Bot) OnMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate
 		return
 	}
 	script := msg[len(bot.option.Prefix):]
-	bot.execShell(script)
-	buf, _ := ioutil.ReadAll(bot.sh.Out.(*bytes.Buffer))
-	output := string(buf)
-	if strings.TrimSpace(output) == "" {
-		output = "`no output`"
-	}
-	if _, err := s.ChannelMessageSend(m.ChannelID, output); err != nil {
-		log.Println(err)
+	key := bot.option.Scope.key(m.Message)
+	ns := namespace(m.Message)
+	submitted := bot.pool.Submit(key, func() {
+		stdout, stderr, status, err := bot.execShell(key, ns, script)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, reply := range render(stdout, stderr, status, bot.option.MaxMessages) {
+			// the rest is still sent, since the last reply has the status
+			if _, err := s.ChannelMessageSendComplex(m.ChannelID, reply); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+	if !submitted {
+		log.Printf("dropped a script in %s since the bot is closing", key)
 	}
 }
 
-func (bot *Bot) execShell(script string) {
-	bot.mu.Lock()
-	defer bot.mu.Unlock()
-
-	bot.sh.Exec(script)
+// execShell runs script in the session of key with the universal variables
+// of the namespace ns. It must not be called for the same key concurrently,
+// which the pool takes care of.
+func (bot *Bot) execShell(key, ns, script string) (stdout, stderr string, status int, err error) {
+	sess, err := bot.sessions.get(key, ns)
+	if err != nil {
+		return
+	}
+	ctx := bot.ctx
+	if bot.option.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bot.option.Timeout)
+		defer cancel()
+	}
+	stdout, stderr, status = sess.exec(ctx, script)
+	return
 }
@@ -0,0 +1,107 @@
+package discord
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// pool runs jobs on a fixed number of workers. Jobs with the same key run
+// one at a time in the order they are submitted, while jobs with different
+// keys may run concurrently.
+type pool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// pending holds the jobs of every key which has any, the first of
+	// which is running or waiting for a worker.
+	pending map[string][]func()
+	// runnable holds the keys whose first job is waiting for a worker.
+	runnable []string
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+func newPool(workers int) *pool {
+	p := &pool{
+		pending: map[string][]func(){},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues job after the other jobs of key. It reports false if the
+// pool has been closed, in which case job never runs.
+func (p *pool) Submit(key string, job func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	jobs := p.pending[key]
+	p.pending[key] = append(jobs, job)
+	if len(jobs) == 0 {
+		p.runnable = append(p.runnable, key)
+		p.cond.Signal()
+	}
+	return true
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish.
+func (p *pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *pool) work() {
+	defer p.wg.Done()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		for len(p.runnable) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.runnable) == 0 {
+			return
+		}
+		key := p.runnable[0]
+		p.runnable = p.runnable[1:]
+		job := p.pending[key][0]
+
+		p.mu.Unlock()
+		run(key, job)
+		p.mu.Lock()
+
+		jobs := p.pending[key][1:]
+		if len(jobs) == 0 {
+			delete(p.pending, key)
+			continue
+		}
+		p.pending[key] = jobs
+		// the other keys go first so that a busy key cannot starve them
+		p.runnable = append(p.runnable, key)
+	}
+}
+
+// run runs job, logging a panic instead of crashing, so that one script
+// which breaks the shell cannot stop the other ones.
+func run(key string, job func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic in a job of %s: %v\n%s", key, err, debug.Stack())
+		}
+	}()
+	job()
+}
@@ -0,0 +1,104 @@
+package discord
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolOrder(t *testing.T) {
+	p := newPool(4)
+
+	var mu sync.Mutex
+	done := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		i := i
+		key := fmt.Sprint("key", i%5)
+		assert.True(t, p.Submit(key, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			done[key] = append(done[key], i)
+		}))
+	}
+	p.Close()
+
+	assert.Len(t, done, 5)
+	for key, order := range done {
+		assert.Len(t, order, 20, "key=%s", key)
+		for j := 1; j < len(order); j++ {
+			assert.True(t, order[j-1] < order[j], "key=%s order=%v", key, order)
+		}
+	}
+	assert.False(t, p.Submit("key0", func() {}))
+}
+
+func TestPoolConcurrency(t *testing.T) {
+	const workers = 3
+	p := newPool(workers)
+	defer p.Close()
+
+	var running, maxRunning int32
+	var perKey [6]int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		key := i % len(perKey)
+		wg.Add(1)
+		p.Submit(fmt.Sprint(key), func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			assert.Equal(t, int32(1), atomic.AddInt32(&perKey[key], 1), "jobs of a key overlap")
+			<-release
+			atomic.AddInt32(&perKey[key], -1)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	// every worker must get busy while the jobs are blocked
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&running) < workers && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(workers), atomic.LoadInt32(&running))
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(workers), maxRunning)
+}
+
+func TestPoolBlockedKey(t *testing.T) {
+	p := newPool(2)
+	defer p.Close()
+
+	blocked := make(chan struct{})
+	p.Submit("slow", func() { <-blocked })
+	p.Submit("slow", func() {})
+
+	done := make(chan struct{})
+	p.Submit("fast", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("a slow key blocks the others")
+	}
+	close(blocked)
+}
+
+func TestPoolPanic(t *testing.T) {
+	p := newPool(1)
+
+	ran := false
+	p.Submit("key", func() { panic("broken") })
+	p.Submit("key", func() { ran = true })
+	p.Close()
+	assert.True(t, ran)
+}
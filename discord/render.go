@@ -0,0 +1,192 @@
+package discord
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// errorColor is the color of the embed which shows the standard error.
+	errorColor = 0xe74c3c
+
+	// messageLimit and embedLimit are the maximum numbers of characters
+	// in the content of a message and in the description of an embed.
+	messageLimit = 2000
+	embedLimit   = 2048
+
+	// fenceLimit is the maximum length of the opening fence of a code
+	// block which is repeated in every chunk the block is split into.
+	fenceLimit = 64
+)
+
+// render builds the replies which show the standard output as the message
+// content, and the standard error and a non-zero exit status in a red embed
+// attached to the last reply. The standard output is split into messages of
+// messageLimit characters, and sent as a file instead if it would take more
+// than maxMessages messages.
+func render(stdout, stderr string, status int, maxMessages int) []*discordgo.MessageSend {
+	var msgs []*discordgo.MessageSend
+	if strings.TrimSpace(stdout) != "" {
+		chunks := splitMessage(stdout, messageLimit)
+		if len(chunks) > maxMessages {
+			msgs = append(msgs, &discordgo.MessageSend{
+				Content: "`the output is too long and attached as a file`",
+				File: &discordgo.File{
+					Name:        "output.txt",
+					ContentType: "text/plain",
+					Reader:      strings.NewReader(stdout),
+				},
+			})
+		} else {
+			for _, chunk := range chunks {
+				msgs = append(msgs, &discordgo.MessageSend{
+					Content: chunk,
+				})
+			}
+		}
+	}
+
+	if strings.TrimSpace(stderr) != "" || status != 0 {
+		embed := &discordgo.MessageEmbed{
+			Color: errorColor,
+			Footer: &discordgo.MessageEmbedFooter{
+				Text: fmt.Sprintf("exit status %d", status),
+			},
+		}
+		if strings.TrimSpace(stderr) != "" {
+			embed.Description = "```\n" + truncate(stderr, embedLimit-len("```\n```")) + "```"
+		}
+		if len(msgs) == 0 {
+			msgs = append(msgs, &discordgo.MessageSend{})
+		}
+		msgs[len(msgs)-1].Embed = embed
+	}
+
+	if len(msgs) == 0 {
+		msgs = append(msgs, &discordgo.MessageSend{
+			Content: "`no output`",
+		})
+	}
+	return msgs
+}
+
+// splitMessage splits s into chunks of at most limit characters on line
+// boundaries, or within a line which is too long by itself. A code block
+// which spans chunks is closed at the end of a chunk and opened again with
+// the same fence at the start of the next one. Discord rejects a message
+// which has nothing but whitespace, so such a chunk is merged into the
+// previous one as far as limit allows, and dropped otherwise.
+func splitMessage(s string, limit int) []string {
+	var (
+		chunks []string
+		chunk  strings.Builder
+		size   int  // characters in chunk
+		empty  bool // whether chunk has nothing but a reopened fence
+		fence  string
+	)
+	empty = true
+	flush := func() {
+		if fence != "" {
+			if !strings.HasSuffix(chunk.String(), "\n") {
+				chunk.WriteString("\n")
+			}
+			chunk.WriteString("```")
+		}
+		chunks = append(chunks, chunk.String())
+		chunk.Reset()
+		size = 0
+		empty = true
+		if fence != "" {
+			chunk.WriteString(fence + "\n")
+			size = utf8.RuneCountInString(fence) + 1
+		}
+	}
+
+	for _, line := range splitLines(s, limit/2) {
+		next := fence
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "```") {
+			if fence == "" {
+				next = trimmed
+				if utf8.RuneCountInString(next) > fenceLimit {
+					next = "```"
+				}
+			} else {
+				next = ""
+			}
+		}
+		// room to close the code block at the end of the chunk
+		reserve := 0
+		if next != "" {
+			reserve = len("\n```")
+		}
+
+		n := utf8.RuneCountInString(line)
+		if !empty && size+n+reserve > limit {
+			flush()
+		}
+		chunk.WriteString(line)
+		size += n
+		empty = false
+		fence = next
+	}
+	if !empty {
+		chunks = append(chunks, chunk.String())
+	}
+	return mergeBlankChunks(chunks, limit)
+}
+
+// mergeBlankChunks appends the chunks which have nothing but whitespace to
+// the previous ones, keeping them within limit characters.
+func mergeBlankChunks(chunks []string, limit int) []string {
+	var merged []string
+	for _, chunk := range chunks {
+		if strings.TrimSpace(chunk) != "" {
+			merged = append(merged, chunk)
+			continue
+		}
+		if len(merged) == 0 {
+			continue
+		}
+		last := merged[len(merged)-1]
+		room := limit - utf8.RuneCountInString(last)
+		if blank := []rune(chunk); room < len(blank) {
+			chunk = string(blank[:room])
+		}
+		merged[len(merged)-1] = last + chunk
+	}
+	return merged
+}
+
+// splitLines splits s into lines, each of which keeps its newline, and
+// splits the lines longer than max characters further.
+func splitLines(s string, max int) []string {
+	var lines []string
+	for _, line := range strings.SplitAfter(s, "\n") {
+		for utf8.RuneCountInString(line) > max {
+			i := 0
+			for n := 0; n < max; n++ {
+				_, size := utf8.DecodeRuneInString(line[i:])
+				i += size
+			}
+			lines = append(lines, line[:i])
+			line = line[i:]
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// truncate shortens s to at most max characters, marking the cut with an
+// ellipsis.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
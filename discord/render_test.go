@@ -0,0 +1,96 @@
+package discord
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMessage(t *testing.T) {
+	for _, tt := range []struct {
+		s        string
+		limit    int
+		expected []string
+	}{
+		{"", 10, nil},
+		{"abc\n", 10, []string{"abc\n"}},
+		{"abc\ndef\nghi\n", 10, []string{"abc\ndef\n", "ghi\n"}},
+		{"abcdefghijkl", 10, []string{"abcdefghij", "kl"}},
+		{"あいうえおか", 4, []string{"あいうえ", "おか"}},
+		{
+			"```go\na\nb\nc\n```\n", 14,
+			[]string{"```go\na\nb\n```", "```go\nc\n```\n"},
+		},
+		{
+			"x\n```\na\n```\ny\n", 12,
+			[]string{"x\n```\na\n```\n", "y\n"},
+		},
+		{"abc\n" + strings.Repeat("\n", 15), 10, []string{"abc" + strings.Repeat("\n", 7)}},
+		{strings.Repeat("\n", 12) + "abc", 10, []string{"\n\nabc"}},
+		{strings.Repeat("a", 9) + "\n\n\n", 10, []string{strings.Repeat("a", 9) + "\n"}},
+	} {
+		assert.Equal(t, tt.expected, splitMessage(tt.s, tt.limit), "%q", tt.s)
+	}
+}
+
+func TestSplitMessageLimit(t *testing.T) {
+	lines := []string{"```sh"}
+	for i := 0; i < 500; i++ {
+		lines = append(lines, strings.Repeat("ghost ", i%20))
+	}
+	lines = append(lines, strings.Repeat("x", 3000), "```", "done")
+	s := strings.Join(lines, "\n")
+
+	chunks := splitMessage(s, messageLimit)
+	assert.True(t, len(chunks) > 1)
+	for i, chunk := range chunks {
+		assert.True(t, utf8.RuneCountInString(chunk) <= messageLimit, "chunk %d", i)
+		if i > 0 {
+			assert.True(t, strings.HasPrefix(chunk, "```sh\n"), "chunk %d", i)
+		}
+	}
+
+	chunks = splitMessage(strings.Repeat("a", messageLimit-1)+"\n\n\n", messageLimit)
+	assert.Equal(t, []string{strings.Repeat("a", messageLimit-1) + "\n"}, chunks)
+}
+
+func TestRender(t *testing.T) {
+	msgs := render("", "", 0, 3)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "`no output`", msgs[0].Content)
+		assert.Nil(t, msgs[0].Embed)
+	}
+
+	msgs = render("", "ghost: oops\n", 127, 3)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "", msgs[0].Content)
+		assert.Equal(t, "```\nghost: oops\n```", msgs[0].Embed.Description)
+		assert.Equal(t, "exit status 127", msgs[0].Embed.Footer.Text)
+	}
+
+	line := strings.Repeat("a", 99) + "\n"
+	stdout := strings.Repeat(line, 30)
+	msgs = render(stdout, "", 1, 3)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, stdout, msgs[0].Content+msgs[1].Content)
+		assert.Nil(t, msgs[0].Embed)
+		assert.NotNil(t, msgs[1].Embed)
+	}
+
+	stdout = strings.Repeat(line, 100)
+	msgs = render(stdout, "", 0, 3)
+	if assert.Len(t, msgs, 1) && assert.NotNil(t, msgs[0].File) {
+		assert.Equal(t, "output.txt", msgs[0].File.Name)
+		b, err := ioutil.ReadAll(msgs[0].File.Reader)
+		assert.Nil(t, err)
+		assert.Equal(t, stdout, string(b))
+	}
+
+	msgs = render("", strings.Repeat("e", 3000), 1, 3)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, embedLimit, utf8.RuneCountInString(msgs[0].Embed.Description))
+	}
+}
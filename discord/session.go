@@ -0,0 +1,199 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/aita/ghost/shell"
+)
+
+// SessionScope tells which messages share a shell session, i.e. variables,
+// functions and files.
+type SessionScope string
+
+const (
+	// ScopeChannel shares a session among the messages in a channel.
+	ScopeChannel SessionScope = "channel"
+	// ScopeUser gives every user a session across guilds.
+	ScopeUser SessionScope = "user"
+	// ScopeGuildUser gives every user a session in each guild.
+	ScopeGuildUser SessionScope = "guild_user"
+)
+
+// key returns the key of the session which runs m.
+func (scope SessionScope) key(m *discordgo.Message) string {
+	switch scope {
+	case ScopeUser:
+		return "user:" + m.Author.ID
+	case ScopeGuildUser:
+		return "guild_user:" + m.GuildID + ":" + m.Author.ID
+	default:
+		return "channel:" + m.ChannelID
+	}
+}
+
+func (scope SessionScope) valid() bool {
+	switch scope {
+	case ScopeChannel, ScopeUser, ScopeGuildUser:
+		return true
+	}
+	return false
+}
+
+// session is a shell with its own output buffers.
+type session struct {
+	sh       *shell.Shell
+	stdout   *bytes.Buffer
+	stderr   *bytes.Buffer
+	lastUsed time.Time
+}
+
+// exec runs script and returns its outputs and exit status. The script is
+// aborted when ctx is done.
+func (sess *session) exec(ctx context.Context, script string) (stdout, stderr string, status int) {
+	sess.sh.ExecWithContext(ctx, script)
+	stdout = sess.stdout.String()
+	stderr = sess.stderr.String()
+	status = sess.sh.Status()
+	sess.stdout.Reset()
+	sess.stderr.Reset()
+	return
+}
+
+// namespace returns the namespace of the universal variables which the
+// script of m uses, which is its guild, or its channel if m is a direct
+// message. It is safe to use in a file name.
+func namespace(m *discordgo.Message) string {
+	if m.GuildID != "" {
+		return "guild_" + m.GuildID
+	}
+	return "dm_" + m.ChannelID
+}
+
+// sessionManager creates sessions lazily and evicts the ones which have not
+// been used for idleTimeout. Every session has its own global variables,
+// and the sessions share the universal ones of each namespace.
+type sessionManager struct {
+	mu          sync.Mutex
+	sessions    map[string]*session
+	idleTimeout time.Duration
+	limits      shell.Limits
+	// storage returns the Storage of a namespace if not nil, and
+	// readonly are pinned in every namespace.
+	storage  func(namespace string) shell.Storage
+	readonly map[string]string
+	// universals are the loaded namespaces, which are kept until the
+	// manager is gone.
+	universals map[string]*universal
+
+	now func() time.Time
+}
+
+// universal is the universal variables of a namespace and their storage.
+type universal struct {
+	env     *shell.Environment
+	storage shell.Storage
+}
+
+func newSessionManager(idleTimeout time.Duration, storage func(namespace string) shell.Storage, limits shell.Limits, readonly map[string]string) *sessionManager {
+	return &sessionManager{
+		sessions:    map[string]*session{},
+		idleTimeout: idleTimeout,
+		limits:      limits,
+		storage:     storage,
+		readonly:    readonly,
+		universals:  map[string]*universal{},
+		now:         time.Now,
+	}
+}
+
+// get returns the session of key, creating it if there is none, which uses
+// the universal variables of ns. The session must not run scripts of other
+// namespaces while it is in use.
+func (m *sessionManager) get(key, ns string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, err := m.universalOf(ns)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	m.evict(now)
+	sess, ok := m.sessions[key]
+	if !ok {
+		stdout := bytes.NewBuffer(nil)
+		stderr := bytes.NewBuffer(nil)
+		sh := &shell.Shell{
+			In:        bytes.NewReader(nil),
+			Out:       stdout,
+			Err:       stderr,
+			Universal: u.env,
+			Storage:   u.storage,
+			Limits:    m.limits,
+		}
+		if err := sh.Init(); err != nil {
+			return nil, fmt.Errorf("creating a session: %s", err)
+		}
+		sess = &session{
+			sh:     sh,
+			stdout: stdout,
+			stderr: stderr,
+		}
+		m.sessions[key] = sess
+	}
+	// a session of a user may move across guilds
+	sess.sh.Universal = u.env
+	sess.sh.Storage = u.storage
+	sess.lastUsed = now
+	return sess, nil
+}
+
+// universalOf returns the universal variables of ns, loading them from the
+// storage and pinning readonly over them if they are not loaded yet. The
+// caller must hold m.mu.
+func (m *sessionManager) universalOf(ns string) (*universal, error) {
+	if u, ok := m.universals[ns]; ok {
+		return u, nil
+	}
+	var storage shell.Storage
+	if m.storage != nil {
+		storage = m.storage(ns)
+	}
+	env, err := shell.LoadUniversal(storage)
+	if err != nil {
+		return nil, fmt.Errorf("loading the universal variables of %s: %s", ns, err)
+	}
+	if m.limits.Storage > 0 {
+		env.LimitStorage(m.limits.Storage)
+	}
+	for name, val := range m.readonly {
+		if err := env.Pin(name, val); err != nil {
+			return nil, fmt.Errorf("pinning $%s in %s: %s", name, ns, err)
+		}
+	}
+	u := &universal{
+		env:     env,
+		storage: storage,
+	}
+	m.universals[ns] = u
+	return u, nil
+}
+
+// evict removes the sessions which have been idle for longer than
+// idleTimeout. Sessions are never evicted if idleTimeout is 0.
+func (m *sessionManager) evict(now time.Time) {
+	if m.idleTimeout <= 0 {
+		return
+	}
+	for key, sess := range m.sessions {
+		if now.Sub(sess.lastUsed) > m.idleTimeout {
+			delete(m.sessions, key)
+		}
+	}
+}
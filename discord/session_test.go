@@ -0,0 +1,214 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aita/ghost/shell"
+)
+
+func TestSessionScopeKey(t *testing.T) {
+	m := &discordgo.Message{
+		ChannelID: "c1",
+		GuildID:   "g1",
+		Author: &discordgo.User{
+			ID: "u1",
+		},
+	}
+	for _, tt := range []struct {
+		scope    SessionScope
+		expected string
+	}{
+		{ScopeChannel, "channel:c1"},
+		{ScopeUser, "user:u1"},
+		{ScopeGuildUser, "guild_user:g1:u1"},
+	} {
+		assert.Equal(t, tt.expected, tt.scope.key(m))
+	}
+	assert.False(t, SessionScope("guild").valid())
+
+	assert.Equal(t, "guild_g1", namespace(m))
+	assert.Equal(t, "dm_c1", namespace(&discordgo.Message{ChannelID: "c1"}))
+}
+
+func TestSessionManager(t *testing.T) {
+	m := newSessionManager(time.Minute, nil, shell.Limits{}, nil)
+	now := time.Unix(0, 0)
+	m.now = func() time.Time { return now }
+
+	exec := func(key, script string) string {
+		sess, err := m.get(key, "guild_g1")
+		assert.Nil(t, err)
+		stdout, _, _ := sess.exec(context.Background(), script)
+		return stdout
+	}
+
+	exec("a", `set x a; set -U u universal`)
+	exec("b", `set x b`)
+	assert.Equal(t, "a universal\n", exec("a", `echo $x $u`))
+	assert.Equal(t, "b universal\n", exec("b", `echo $x $u`))
+
+	now = now.Add(50 * time.Second)
+	exec("a", `echo keep alive`)
+	now = now.Add(50 * time.Second)
+	assert.Equal(t, "[a]\n", exec("a", `echo [$x]`))
+	assert.Len(t, m.sessions, 1, "b must be evicted")
+	assert.Equal(t, "[] universal\n", exec("b", `echo [$x] $u`))
+}
+
+func TestSessionManagerNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	storage := func(ns string) shell.Storage {
+		return shell.NewFileStorage(filepath.Join(dir, ns+".json"))
+	}
+	m := newSessionManager(0, storage, shell.Limits{}, nil)
+
+	exec := func(key, ns, script string) string {
+		sess, err := m.get(key, ns)
+		assert.Nil(t, err)
+		stdout, _, _ := sess.exec(context.Background(), script)
+		return stdout
+	}
+
+	exec("a", "guild_g1", `set -U u g1`)
+	exec("b", "guild_g2", `set -U u g2`)
+	assert.Equal(t, "g1\n", exec("c", "guild_g1", `echo $u`))
+	assert.Equal(t, "g2\n", exec("d", "guild_g2", `echo $u`))
+
+	// a session of a user follows the user across guilds
+	exec("user", "guild_g1", `set g global`)
+	assert.Equal(t, "global g2\n", exec("user", "guild_g2", `echo $g $u`))
+	assert.Equal(t, "[]\n", exec("user", "dm_c1", `echo [$u]`))
+
+	reloaded := newSessionManager(0, storage, shell.Limits{}, nil)
+	sess, err := reloaded.get("a", "guild_g2")
+	if assert.Nil(t, err) {
+		stdout, _, _ := sess.exec(context.Background(), `echo $u`)
+		assert.Equal(t, "g2\n", stdout)
+	}
+}
+
+func TestSessionManagerReadonly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	storage := func(ns string) shell.Storage {
+		return shell.NewFileStorage(filepath.Join(dir, ns+".json"))
+	}
+
+	m := newSessionManager(0, storage, shell.Limits{}, map[string]string{"greeting": "hello"})
+	sess, err := m.get("a", "guild_g1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	stdout, stderr, status := sess.exec(context.Background(), `set -U greeting bye; unset -U greeting; echo $greeting`)
+	assert.Equal(t, "hello\n", stdout)
+	assert.Equal(t, "ghost: greeting: readonly variable\nghost: greeting: readonly variable\n", stderr)
+	assert.Equal(t, 0, status)
+
+	// the variable is no longer pinned once the operator removes it
+	m = newSessionManager(0, storage, shell.Limits{}, nil)
+	sess, err = m.get("a", "guild_g1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	stdout, stderr, _ = sess.exec(context.Background(), `echo $greeting; set -U greeting bye; echo $greeting; unset -U greeting`)
+	assert.Equal(t, "hello\nbye\n", stdout)
+	assert.Equal(t, "", stderr)
+}
+
+func TestSessionExec(t *testing.T) {
+	m := newSessionManager(0, nil, shell.Limits{}, nil)
+	sess, err := m.get("a", "guild_g1")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	stdout, stderr, status := sess.exec(context.Background(), `echo out; unknown`)
+	assert.Equal(t, "out\n", stdout)
+	assert.Equal(t, "ghost: unknown command \"unknown\"\n", stderr)
+	assert.Equal(t, 127, status)
+
+	stdout, stderr, status = sess.exec(context.Background(), `echo again`)
+	assert.Equal(t, "again\n", stdout)
+	assert.Equal(t, "", stderr)
+	assert.Equal(t, 0, status)
+}
+
+func TestBotConcurrentSessions(t *testing.T) {
+	sessions := newSessionManager(time.Minute, nil, shell.Limits{}, nil)
+	bot := &Bot{
+		sessions: sessions,
+		pool:     newPool(4),
+		ctx:      context.Background(),
+	}
+
+	var mu sync.Mutex
+	outputs := map[string][]string{}
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			key, script := key, fmt.Sprintf(`set -U last %d; let n=n+1; echo %s $n`, i, key)
+			bot.pool.Submit(key, func() {
+				stdout, _, _, err := bot.execShell(key, "guild_g1", script)
+				assert.Nil(t, err)
+				mu.Lock()
+				defer mu.Unlock()
+				outputs[key] = append(outputs[key], stdout)
+			})
+		}
+	}
+	bot.pool.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if assert.Len(t, outputs[key], 20) {
+			for i, out := range outputs[key] {
+				assert.Equal(t, fmt.Sprintf("%s %d\n", key, i+1), out)
+			}
+		}
+	}
+	last, _ := sessions.universals["guild_g1"].env.Get("last")
+	assert.Equal(t, "19", last)
+}
+
+func TestBotTimeout(t *testing.T) {
+	sessions := newSessionManager(0, nil, shell.Limits{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	bot := &Bot{
+		sessions: sessions,
+		option: BotOption{
+			Timeout: 50 * time.Millisecond,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	stdout, stderr, status, err := bot.execShell("a", "guild_g1", `echo start; while test 1; end`)
+	assert.Nil(t, err)
+	assert.Equal(t, "start\n", stdout)
+	assert.Equal(t, "ghost: timeout\n", stderr)
+	assert.Equal(t, 124, status)
+
+	stdout, _, status, _ = bot.execShell("a", "guild_g1", `echo ok`)
+	assert.Equal(t, "ok\n", stdout)
+	assert.Equal(t, 0, status)
+
+	bot.cancel()
+	_, stderr, status, _ = bot.execShell("a", "guild_g1", `while test 1; end`)
+	assert.Equal(t, "ghost: canceled\n", stderr)
+	assert.Equal(t, 130, status)
+}
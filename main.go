@@ -4,15 +4,28 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/spf13/viper"
 
 	"github.com/aita/ghost/discord"
+	"github.com/aita/ghost/shell"
 )
 
 func init() {
 	viper.SetDefault("shell.prefix", "%")
+	viper.SetDefault("shell.storage_dir", "")
+	viper.SetDefault("shell.session", string(discord.ScopeChannel))
+	viper.SetDefault("shell.idle_timeout", "1h")
+	viper.SetDefault("shell.workers", 0)
+	viper.SetDefault("shell.timeout", "10s")
+	viper.SetDefault("shell.max_messages", 3)
+	viper.SetDefault("shell.limits.steps", 100000)
+	viper.SetDefault("shell.limits.output", 64*1024)
+	viper.SetDefault("shell.limits.storage", 1024*1024)
+	viper.SetDefault("shell.limits.depth", 100)
+	viper.SetDefault("shell.limits.memory", 4*1024*1024)
 }
 
 func die(err error) {
@@ -32,7 +45,29 @@ func main() {
 
 	token := viper.GetString("discord.token")
 	opt := discord.BotOption{
-		Prefix: viper.GetString("shell.prefix"),
+		Prefix:      viper.GetString("shell.prefix"),
+		Scope:       discord.SessionScope(viper.GetString("shell.session")),
+		IdleTimeout: viper.GetDuration("shell.idle_timeout"),
+		Workers:     viper.GetInt("shell.workers"),
+		Timeout:     viper.GetDuration("shell.timeout"),
+		MaxMessages: viper.GetInt("shell.max_messages"),
+		Readonly:    viper.GetStringMapString("shell.readonly"),
+		Limits: shell.Limits{
+			Steps:   viper.GetInt("shell.limits.steps"),
+			Output:  viper.GetInt("shell.limits.output"),
+			Storage: viper.GetInt("shell.limits.storage"),
+			Depth:   viper.GetInt("shell.limits.depth"),
+			Memory:  viper.GetInt("shell.limits.memory"),
+		},
+	}
+	if dir := viper.GetString("shell.storage_dir"); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			die(err)
+		}
+		// a file for each guild
+		opt.Storage = func(namespace string) shell.Storage {
+			return shell.NewFileStorage(filepath.Join(dir, namespace+".json"))
+		}
 	}
 	bot, err := discord.NewBot(token, opt)
 	if err != nil {
@@ -0,0 +1,334 @@
+package shell
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errDivisionByZero  = fmt.Errorf("division by zero")
+	errIntegerOverflow = fmt.Errorf("integer overflow")
+)
+
+// arithOperators are the operators of arithmetic expressions. Longer
+// operators come first so that they are matched before their prefixes.
+var arithOperators = []string{
+	"||", "&&", "==", "!=", "<=", ">=",
+	"<", ">", "+", "-", "*", "/", "%", "!", "(", ")",
+}
+
+// evalArith evaluates an integer expression such as the body of $((...)).
+// Variables are referred to by their names without `$`; unset or empty
+// variables evaluate to 0.
+func evalArith(env *Environment, expr string) (int64, error) {
+	toks, err := tokenizeArith(expr)
+	if err != nil {
+		return 0, err
+	}
+	a := &arith{
+		env:  env,
+		toks: toks,
+	}
+	n := a.parseOr()
+	if a.err == nil && a.pos < len(a.toks) {
+		a.fail(fmt.Errorf("syntax error near %q", a.toks[a.pos]))
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	return n, nil
+}
+
+func tokenizeArith(expr string) ([]string, error) {
+	var toks []string
+	for len(expr) > 0 {
+		ch := expr[0]
+		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' {
+			expr = expr[1:]
+			continue
+		}
+
+		n := 0
+		switch {
+		case isDigit(ch):
+			for n < len(expr) && isDigit(expr[n]) {
+				n++
+			}
+		case isNameStart(ch):
+			for n < len(expr) && (isNameStart(expr[n]) || isDigit(expr[n])) {
+				n++
+			}
+		default:
+			for _, op := range arithOperators {
+				if strings.HasPrefix(expr, op) {
+					n = len(op)
+					break
+				}
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("syntax error near %q", expr[:1])
+			}
+		}
+		toks = append(toks, expr[:n])
+		expr = expr[n:]
+	}
+	return toks, nil
+}
+
+// isName reports whether s is a valid variable name in arithmetic
+// expressions.
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+// arith is a recursive descent evaluator of arithmetic expressions.
+type arith struct {
+	env  *Environment
+	toks []string
+	pos  int
+	err  error
+
+	// skip is positive while evaluating the right operand of a
+	// short-circuited && or ||, whose errors must not be reported.
+	skip int
+}
+
+func (a *arith) fail(err error) {
+	if a.err == nil && a.skip == 0 {
+		a.err = err
+	}
+}
+
+func (a *arith) peek() string {
+	if a.pos < len(a.toks) {
+		return a.toks[a.pos]
+	}
+	return ""
+}
+
+func (a *arith) accept(ops ...string) (string, bool) {
+	tok := a.peek()
+	for _, op := range ops {
+		if tok == op {
+			a.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (a *arith) parseOr() int64 {
+	x := a.parseAnd()
+	for {
+		if _, ok := a.accept("||"); !ok {
+			return x
+		}
+		if x != 0 {
+			a.skip++
+			a.parseAnd()
+			a.skip--
+		} else {
+			x = a.parseAnd()
+		}
+		x = boolToInt(x != 0)
+	}
+}
+
+func (a *arith) parseAnd() int64 {
+	x := a.parseEquality()
+	for {
+		if _, ok := a.accept("&&"); !ok {
+			return x
+		}
+		if x == 0 {
+			a.skip++
+			a.parseEquality()
+			a.skip--
+		} else {
+			x = a.parseEquality()
+		}
+		x = boolToInt(x != 0)
+	}
+}
+
+func (a *arith) parseEquality() int64 {
+	x := a.parseRelational()
+	for {
+		op, ok := a.accept("==", "!=")
+		if !ok {
+			return x
+		}
+		y := a.parseRelational()
+		if op == "==" {
+			x = boolToInt(x == y)
+		} else {
+			x = boolToInt(x != y)
+		}
+	}
+}
+
+func (a *arith) parseRelational() int64 {
+	x := a.parseAdditive()
+	for {
+		op, ok := a.accept("<", "<=", ">", ">=")
+		if !ok {
+			return x
+		}
+		y := a.parseAdditive()
+		switch op {
+		case "<":
+			x = boolToInt(x < y)
+		case "<=":
+			x = boolToInt(x <= y)
+		case ">":
+			x = boolToInt(x > y)
+		case ">=":
+			x = boolToInt(x >= y)
+		}
+	}
+}
+
+func (a *arith) parseAdditive() int64 {
+	x := a.parseMultiplicative()
+	for {
+		op, ok := a.accept("+", "-")
+		if !ok {
+			return x
+		}
+		y := a.parseMultiplicative()
+		if op == "-" {
+			if y == math.MinInt64 {
+				if x >= 0 {
+					a.fail(errIntegerOverflow)
+				}
+				x = x - y
+				continue
+			}
+			y = -y
+		}
+		if (y > 0 && x > math.MaxInt64-y) || (y < 0 && x < math.MinInt64-y) {
+			a.fail(errIntegerOverflow)
+		}
+		x += y
+	}
+}
+
+func (a *arith) parseMultiplicative() int64 {
+	x := a.parseUnary()
+	for {
+		op, ok := a.accept("*", "/", "%")
+		if !ok {
+			return x
+		}
+		y := a.parseUnary()
+		switch op {
+		case "*":
+			if x != 0 && y != 0 {
+				z := x * y
+				if z/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+					a.fail(errIntegerOverflow)
+				}
+				x = z
+			}
+		case "/", "%":
+			if y == 0 {
+				a.fail(errDivisionByZero)
+				x = 0
+				continue
+			}
+			if x == math.MinInt64 && y == -1 && op == "/" {
+				a.fail(errIntegerOverflow)
+			}
+			if op == "/" {
+				x /= y
+			} else {
+				x %= y
+			}
+		}
+	}
+}
+
+func (a *arith) parseUnary() int64 {
+	op, ok := a.accept("-", "+", "!")
+	if !ok {
+		return a.parsePrimary()
+	}
+	x := a.parseUnary()
+	switch op {
+	case "-":
+		if x == math.MinInt64 {
+			a.fail(errIntegerOverflow)
+		}
+		return -x
+	case "!":
+		return boolToInt(x == 0)
+	}
+	return x
+}
+
+func (a *arith) parsePrimary() int64 {
+	tok := a.peek()
+	switch {
+	case tok == "":
+		a.fail(fmt.Errorf("syntax error: unexpected end of expression"))
+		return 0
+	case tok == "(":
+		a.pos++
+		x := a.parseOr()
+		if _, ok := a.accept(")"); !ok {
+			a.fail(fmt.Errorf("syntax error: missing )"))
+		}
+		return x
+	case isDigit(tok[0]):
+		a.pos++
+		n, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			a.fail(errIntegerOverflow)
+		}
+		return n
+	case isNameStart(tok[0]):
+		a.pos++
+		return a.variable(tok)
+	}
+	a.fail(fmt.Errorf("syntax error near %q", tok))
+	a.pos++
+	return 0
+}
+
+func (a *arith) variable(name string) int64 {
+	val, _ := a.env.Get(name)
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		a.fail(fmt.Errorf("%s: not an integer: %q", name, val))
+	}
+	return n
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalArith(t *testing.T) {
+	env := &Environment{
+		store: map[string]string{
+			"x":    "6",
+			"y":    " -2 ",
+			"word": "hello",
+		},
+	}
+
+	for _, tt := range []struct {
+		expr     string
+		expected int64
+		err      string
+	}{
+		{"1 + 2 * 3", 7, ""},
+		{"(1 + 2) * 3", 9, ""},
+		{"7 / 2", 3, ""},
+		{"7 % 4", 3, ""},
+		{"-7 / 2", -3, ""},
+		{"x * y", -12, ""},
+		{"x - -y", 4, ""},
+		{"unset + 1", 1, ""},
+		{"1 < 2", 1, ""},
+		{"2 <= 1", 0, ""},
+		{"x >= 6 && y > 0", 0, ""},
+		{"x == 6 || 1 / 0", 1, ""},
+		{"0 && 1 / 0", 0, ""},
+		{"!x", 0, ""},
+		{"!(x != 6)", 1, ""},
+		{"1 / 0", 0, "division by zero"},
+		{"1 % 0", 0, "division by zero"},
+		{"9223372036854775807 + 1", 0, "integer overflow"},
+		{"-9223372036854775807 - 2", 0, "integer overflow"},
+		{"4611686018427387904 * 2", 0, "integer overflow"},
+		{"99999999999999999999", 0, "integer overflow"},
+		{"word + 1", 0, `word: not an integer: "hello"`},
+		{"(1 + 2", 0, "syntax error: missing )"},
+		{"1 +", 0, "syntax error: unexpected end of expression"},
+		{"1 2", 0, `syntax error near "2"`},
+		{"1 ^ 2", 0, `syntax error near "^"`},
+	} {
+		n, err := evalArith(env, tt.expr)
+		if tt.err != "" {
+			if assert.NotNil(t, err, "expr=%q", tt.expr) {
+				assert.Equal(t, tt.err, err.Error(), "expr=%q", tt.expr)
+			}
+			continue
+		}
+		assert.Nil(t, err, "expr=%q", tt.expr)
+		assert.Equal(t, tt.expected, n, "expr=%q", tt.expr)
+	}
+}
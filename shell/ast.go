@@ -8,12 +8,44 @@ type Program struct {
 }
 
 type WordNode struct {
-	Token *Token
-	Value string
+	Token  *Token
+	Value  string
+	Substs []*SubstNode // command substitutions in order of appearance
+}
+
+type SubstNode struct {
+	Prog *Program
 }
 
 type CommandNode struct {
-	List []*WordNode
+	List      []*WordNode
+	Redirects []*RedirectNode
+}
+
+type RedirectNode struct {
+	Op      TokenKind // GREAT, DGREAT, LESS, DLESS or DLESSDASH
+	Target  *WordNode
+	Heredoc *Heredoc // body of DLESS and DLESSDASH
+}
+
+type Heredoc struct {
+	Pos    Position // position of the first line of the body
+	Body   string
+	Expand bool // false if the delimiter is quoted
+}
+
+type PipelineNode struct {
+	List []*CommandNode
+}
+
+type NotNode struct {
+	Body Node
+}
+
+type AndOrNode struct {
+	Op    TokenKind // AND or OR
+	Left  Node
+	Right Node
 }
 
 type BlockNode struct {
@@ -26,5 +58,41 @@ type IfNode struct {
 	Else Node
 }
 
+type SwitchNode struct {
+	Value *WordNode
+	Cases []*CaseNode
+}
+
+type CaseNode struct {
+	Patterns []*WordNode
+	Body     *BlockNode
+}
+
+type WhileNode struct {
+	Cond Node
+	Body *BlockNode
+}
+
+type ForNode struct {
+	Var  *WordNode
+	List []*WordNode
+	Body *BlockNode
+}
+
+type FunctionNode struct {
+	Name *WordNode
+	Body *BlockNode
+}
+
+type BreakNode struct {
+	Token *Token
+	Count int
+}
+
+type ContinueNode struct {
+	Token *Token
+	Count int
+}
+
 type BadNode struct {
 }
@@ -2,6 +2,9 @@ package shell
 
 import (
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -10,11 +13,11 @@ var builtins []builtinCommand
 type builtinCommand struct {
 	name string
 	desc string
-	run  func(sh *Shell, env *Environment, args []string) int
+	run  CommandFunc
 }
 
-func (cmd builtinCommand) Run(sh *Shell, env *Environment, args []string) int {
-	return cmd.run(sh, env, args)
+func (cmd builtinCommand) Run(ctx *ExecContext, args []string) int {
+	return cmd.run(ctx, args)
 }
 
 func init() {
@@ -29,32 +32,367 @@ func init() {
 			desc: "display a line of text",
 			run:  echo,
 		},
+		{
+			name: "cat",
+			desc: "concatenate files to output",
+			run:  cat,
+		},
 		{
 			name: "set",
 			desc: "change shell variables",
 			run:  set,
 		},
+		{
+			name: "unset",
+			desc: "remove shell variables",
+			run:  unset,
+		},
+		{
+			name: "readonly",
+			desc: "make shell variables readonly",
+			run:  readonly,
+		},
+		{
+			name: "test",
+			desc: "evaluate a conditional expression",
+			run:  testCmd,
+		},
+		{
+			name: "[",
+			desc: "evaluate a conditional expression",
+			run:  bracket,
+		},
+		{
+			name: "math",
+			desc: "evaluate an arithmetic expression",
+			run:  mathCmd,
+		},
+		{
+			name: "let",
+			desc: "evaluate arithmetic expressions and assign variables",
+			run:  let,
+		},
+		{
+			name: "return",
+			desc: "stop the current function",
+			run:  ret,
+		},
 	}
 }
 
-func help(sh *Shell, env *Environment, args []string) int {
+func help(ctx *ExecContext, args []string) int {
 	for _, cmd := range builtins {
-		fmt.Fprintf(sh.Out, "%s\t\t%s\n", cmd.name, cmd.desc)
+		fmt.Fprintf(ctx.Stdout, "%s\t\t%s\n", cmd.name, cmd.desc)
 	}
 	return 0
 }
 
-func echo(sh *Shell, env *Environment, args []string) int {
+func echo(ctx *ExecContext, args []string) int {
 	s := strings.Join(args[1:], " ")
-	fmt.Fprintln(sh.Out, s)
+	fmt.Fprintln(ctx.Stdout, s)
+	return 0
+}
+
+// cat copies the named files, or the standard input if none, to the
+// standard output. The name "-" also stands for the standard input.
+func cat(ctx *ExecContext, args []string) int {
+	if len(args) == 1 {
+		args = append(args, "-")
+	}
+
+	status := 0
+	for _, name := range args[1:] {
+		var r io.Reader
+		if name == "-" {
+			r = ctx.Stdin
+		} else {
+			f, err := ctx.Shell.FS.Open(name)
+			if err != nil {
+				fmt.Fprintln(ctx.Stderr, "cat:", err)
+				status = 1
+				continue
+			}
+			defer f.Close()
+			r = f
+		}
+		if _, err := io.Copy(ctx.Stdout, &contextReader{ctx, r}); err != nil {
+			if ctx.Err() != nil {
+				// the script is aborted, which is reported by the shell
+				return 1
+			}
+			fmt.Fprintln(ctx.Stderr, "cat:", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+const setUsage = `usage: set [-l|-g|-U] [-r] VARIABLE_NAME VALUE
+       set [-l|-g|-U] [-r] -a VARIABLE_NAME [VALUE...]
+       set [-l|-g|-U]`
+
+// set assigns a value to a variable, or a list of values with -a. The
+// variable is in the current scope, which is local to the function if any,
+// unless a scope is given: -l local, -g global or -U universal. Global
+// variables are kept between scripts, and universal ones are outside of
+// them. With -r, the variable becomes readonly unless it is universal. With
+// no variable, set lists the variables of the scope, or all the visible
+// ones.
+func set(ctx *ExecContext, args []string) int {
+	env, args, ok := scopeFlags(ctx, "set", args, "ar")
+	if !ok {
+		fmt.Fprintln(ctx.Stderr, setUsage)
+		return 1
+	}
+	list, readonly := false, false
+	for len(args) > 1 && (args[1] == "-a" || args[1] == "-r") {
+		if args[1] == "-a" {
+			list = true
+		} else {
+			readonly = true
+		}
+		args = append(args[:1], args[2:]...)
+	}
+	if readonly && env == ctx.Shell.Universal && len(args) > 1 {
+		ctx.Shell.fail(ctx, errUniversalReadonly(args[1]))
+		return 1
+	}
+	if env == nil {
+		env = ctx.Env
+		if len(args) == 1 {
+			// every visible variable
+			env = nil
+		}
+	}
+
+	var err error
+	switch {
+	case len(args) == 1 && !list && !readonly:
+		listVariables(ctx, env)
+		return 0
+	case list && len(args) >= 2:
+		err = env.SetList(args[1], args[2:])
+	case !list && len(args) == 3:
+		err = env.Set(args[1], args[2])
+	default:
+		fmt.Fprintln(ctx.Stderr, setUsage)
+		return 1
+	}
+	if err == nil && readonly {
+		err = env.SetReadonly(args[1])
+	}
+	if err != nil {
+		ctx.Shell.fail(ctx, err)
+		return 1
+	}
+	return 0
+}
+
+// unset removes variables from the innermost scope which has them, or from
+// the given scope.
+func unset(ctx *ExecContext, args []string) int {
+	env, args, ok := scopeFlags(ctx, "unset", args, "")
+	if !ok || len(args) < 2 {
+		fmt.Fprintln(ctx.Stderr, "usage: unset [-l|-g|-U] VARIABLE_NAME...")
+		return 1
+	}
+	status := 0
+	for _, name := range args[1:] {
+		scope := env
+		if scope == nil {
+			scope = ctx.Env.find(name)
+		}
+		if scope == nil {
+			continue
+		}
+		if err := scope.Unset(name); err != nil {
+			ctx.Shell.fail(ctx, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// readonly makes variables readonly, assigning values to them first if
+// given as NAME=VALUE. Universal variables cannot be made readonly. With no
+// arguments, it lists the readonly variables.
+func readonly(ctx *ExecContext, args []string) int {
+	if len(args) == 1 {
+		for _, name := range visibleNames(ctx.Env) {
+			if ctx.Env.IsReadonly(name) {
+				val, _ := ctx.Env.Get(name)
+				fmt.Fprintln(ctx.Stdout, name, val)
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args[1:] {
+		var err error
+		name := arg
+		if index := strings.IndexByte(arg, '='); index >= 0 {
+			name = arg[:index]
+			err = ctx.Env.Set(name, arg[index+1:])
+		}
+		if err == nil {
+			switch scope := ctx.Env.find(name); scope {
+			case nil:
+				err = fmt.Errorf("%s: not set", name)
+			case ctx.Shell.Universal:
+				err = errUniversalReadonly(name)
+			default:
+				err = scope.SetReadonly(name)
+			}
+		}
+		if err != nil {
+			ctx.Shell.fail(ctx, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// errUniversalReadonly is the error of a script which tries to make a
+// universal variable readonly. Only the operator can pin them, since they
+// are shared with the other sessions.
+func errUniversalReadonly(name string) error {
+	return fmt.Errorf("%s: universal variables cannot be made readonly", name)
+}
+
+// scopeFlags consumes the leading -l, -g and -U of args and returns the
+// environment of the scope, or nil if none is given. The flags in others are
+// left in args for the caller.
+func scopeFlags(ctx *ExecContext, name string, args []string, others string) (*Environment, []string, bool) {
+	var env *Environment
+	rest := []string{args[0]}
+	i := 1
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		for _, flag := range args[i][1:] {
+			var scope *Environment
+			switch flag {
+			case 'l':
+				scope = ctx.Env
+			case 'g':
+				scope = ctx.Shell.topLevel
+			case 'U':
+				scope = ctx.Shell.Universal
+			default:
+				if strings.ContainsRune(others, flag) {
+					rest = append(rest, "-"+string(flag))
+					continue
+				}
+				fmt.Fprintf(ctx.Stderr, "%s: unknown option -%c\n", name, flag)
+				return nil, nil, false
+			}
+			if env != nil && env != scope {
+				fmt.Fprintf(ctx.Stderr, "%s: conflicting scopes\n", name)
+				return nil, nil, false
+			}
+			env = scope
+		}
+	}
+	return env, append(rest, args[i:]...), true
+}
+
+// listVariables writes the variables of env, or the ones visible from the
+// current scope if env is nil, with their values.
+func listVariables(ctx *ExecContext, env *Environment) {
+	var names []string
+	if env != nil {
+		names = env.Names()
+	} else {
+		env = ctx.Env
+		names = visibleNames(env)
+	}
+	for _, name := range names {
+		val, _ := env.Get(name)
+		fmt.Fprintln(ctx.Stdout, name, val)
+	}
+}
+
+// visibleNames returns the sorted names of the variables of env and its
+// outer environments.
+func visibleNames(env *Environment) []string {
+	var names []string
+	seen := map[string]bool{}
+	for e := env; e != nil; e = e.outer {
+		for _, name := range e.Names() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mathCmd(ctx *ExecContext, args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(ctx.Stderr, "usage: math EXPRESSION")
+		return 1
+	}
+	n, err := evalArith(ctx.Env, strings.Join(args[1:], " "))
+	if err != nil {
+		fmt.Fprintln(ctx.Stderr, "math:", err)
+		return 1
+	}
+	fmt.Fprintln(ctx.Stdout, n)
 	return 0
 }
 
-func set(sh *Shell, env *Environment, args []string) int {
-	if len(args) != 3 {
-		fmt.Fprintln(sh.Out, "usage: set VARIABLE_NAME VALUE")
+// let evaluates each argument as an arithmetic expression. An argument of
+// the form NAME=EXPRESSION assigns the result to NAME. The status is 1 if
+// the last result is 0, and 0 otherwise.
+func let(ctx *ExecContext, args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(ctx.Stderr, "usage: let [NAME=]EXPRESSION...")
+		return 1
+	}
+	var n int64
+	for _, arg := range args[1:] {
+		name, expr := "", arg
+		if index := strings.IndexByte(arg, '='); index > 0 && isName(arg[:index]) && !strings.HasPrefix(arg[index+1:], "=") {
+			name, expr = arg[:index], arg[index+1:]
+		}
+		var err error
+		n, err = evalArith(ctx.Env, expr)
+		if err != nil {
+			fmt.Fprintln(ctx.Stderr, "let:", err)
+			return 1
+		}
+		if name != "" {
+			if err := ctx.Env.Set(name, strconv.FormatInt(n, 10)); err != nil {
+				ctx.Shell.fail(ctx, err)
+				return 1
+			}
+		}
+	}
+	if n == 0 {
 		return 1
 	}
-	env.Set(args[1], args[2])
 	return 0
 }
+
+func ret(ctx *ExecContext, args []string) int {
+	status := ctx.Shell.status
+	if !ctx.inFunction {
+		fmt.Fprintln(ctx.Stderr, "return: not in a function")
+		return 1
+	}
+	if len(args) > 2 {
+		fmt.Fprintln(ctx.Stderr, "usage: return [STATUS]")
+		return 1
+	}
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(ctx.Stderr, "return: %s: numeric argument required\n", args[1])
+			return 2
+		}
+		status = n
+	}
+	ctx.Shell.flow = flowReturn
+	return status
+}
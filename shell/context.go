@@ -0,0 +1,62 @@
+package shell
+
+import (
+	"context"
+	"io"
+)
+
+// ExecContext carries everything a single command invocation needs: the
+// shell it runs in, the caller's environment and its own standard streams.
+// The embedded context.Context is cancelled when the command should stop.
+type ExecContext struct {
+	context.Context
+
+	Shell *Shell
+	Env   *Environment
+	Args  []string // positional parameters $1, $2, ...
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// inFunction tells whether the command runs in the body of a function,
+	// where return is allowed.
+	inFunction bool
+}
+
+// WithEnv returns a copy of ctx which evaluates in env.
+func (ctx *ExecContext) WithEnv(env *Environment) *ExecContext {
+	c := *ctx
+	c.Env = env
+	return &c
+}
+
+// WithIO returns a copy of ctx with its standard input and output replaced.
+func (ctx *ExecContext) WithIO(stdin io.Reader, stdout io.Writer) *ExecContext {
+	c := *ctx
+	c.Stdin = stdin
+	c.Stdout = stdout
+	return &c
+}
+
+// contextReader reads from r until ctx is done, so that copying a large
+// input stops in time.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// CommandFunc is an adapter to allow the use of ordinary functions as
+// commands.
+type CommandFunc func(ctx *ExecContext, args []string) int
+
+func (f CommandFunc) Run(ctx *ExecContext, args []string) int {
+	return f(ctx, args)
+}
@@ -1,26 +1,329 @@
 package shell
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Environment holds variables. A variable is either a string or a list of
+// strings, which reads as a string of its elements joined with spaces.
+//
+// Environment is safe for concurrent use, so that shells can share one such
+// as the universal variables.
 type Environment struct {
-	store map[string]string
-	outer *Environment
+	mu       sync.RWMutex
+	store    map[string]string
+	lists    map[string][]string
+	readonly map[string]bool
+	outer    *Environment
+
+	// quota bounds the size of the variables of e, and is shared with the
+	// environments created by child.
+	quota *quota
+
+	// modified is set whenever a variable of e is changed.
+	modified bool
+}
+
+// LimitStorage bounds the size of the variables of e and the environments
+// inside it to max bytes, counting the lengths of names and values. The
+// variables which e already has are counted as well.
+func (e *Environment) LimitStorage(max int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.quota = &quota{
+		limit: "variable storage",
+		max:   max,
+		used:  e.size(),
+	}
+}
+
+// child returns a new environment inside e, such as the local one of a
+// function, which shares the quota of e.
+func (e *Environment) child() *Environment {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return &Environment{
+		outer: e,
+		quota: e.quota,
+	}
+}
+
+// release gives the size of the variables of e back to its quota when e is
+// no longer used.
+func (e *Environment) release() {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	e.quota.add(-e.size())
+}
+
+// size returns the size of the variables of e. The caller must hold e.mu.
+func (e *Environment) size() int {
+	size := 0
+	for name := range e.store {
+		size += e.sizeOf(name)
+	}
+	for name := range e.lists {
+		size += e.sizeOf(name)
+	}
+	return size
+}
+
+// sizeOf returns the size of the named variable of e, which is 0 if e does
+// not have it. The caller must hold e.mu.
+func (e *Environment) sizeOf(name string) int {
+	if val, ok := e.store[name]; ok {
+		return len(name) + len(val)
+	}
+	list, ok := e.lists[name]
+	if !ok {
+		return 0
+	}
+	return len(name) + listSize(list)
+}
+
+func listSize(list []string) int {
+	size := 0
+	for _, s := range list {
+		size += len(s)
+	}
+	return size
+}
+
+// variable is a snapshot of a variable.
+type variable struct {
+	val      string
+	list     []string
+	isList   bool
+	readonly bool
+}
+
+// lookup returns the named variable of e, not of the outer environments.
+func (e *Environment) lookup(name string) (variable, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if list, ok := e.lists[name]; ok {
+		return variable{list: list, isList: true, readonly: e.readonly[name]}, true
+	}
+	if val, ok := e.store[name]; ok {
+		return variable{val: val, readonly: e.readonly[name]}, true
+	}
+	return variable{}, false
+}
+
+// resolve returns the named variable of the innermost environment which has
+// it, and that environment. The environment is nil if there is no such one.
+func (e *Environment) resolve(name string) (variable, *Environment) {
+	for env := e; env != nil; env = env.outer {
+		if v, ok := env.lookup(name); ok {
+			return v, env
+		}
+	}
+	return variable{}, nil
+}
+
+// find returns the innermost environment which defines name, or nil.
+func (e *Environment) find(name string) *Environment {
+	_, env := e.resolve(name)
+	return env
 }
 
 func (e *Environment) Get(name string) (string, bool) {
-	if e.store != nil {
-		s, ok := e.store[name]
-		if ok {
-			return s, ok
+	v, env := e.resolve(name)
+	if v.isList {
+		return strings.Join(v.list, " "), true
+	}
+	return v.val, env != nil
+}
+
+// GetList returns the elements of the named variable. A string variable is
+// a list of one element.
+func (e *Environment) GetList(name string) ([]string, bool) {
+	v, env := e.resolve(name)
+	if env == nil {
+		return nil, false
+	}
+	if v.isList {
+		return v.list, true
+	}
+	return []string{v.val}, true
+}
+
+// IsList reports whether the named variable is a list.
+func (e *Environment) IsList(name string) bool {
+	v, _ := e.resolve(name)
+	return v.isList
+}
+
+// IsReadonly reports whether the named variable is readonly.
+func (e *Environment) IsReadonly(name string) bool {
+	v, _ := e.resolve(name)
+	return v.readonly
+}
+
+// SetReadonly makes the named variable of e readonly, so that neither e nor
+// the environments inside it can change it. It is an error if e does not
+// have the variable.
+func (e *Environment) SetReadonly(name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.store[name]; !ok {
+		if _, ok := e.lists[name]; !ok {
+			return fmt.Errorf("%s: not set", name)
 		}
 	}
-	if e.outer != nil {
-		return e.outer.Get(name)
+	if e.readonly == nil {
+		e.readonly = map[string]bool{}
 	}
-	return "", false
+	e.readonly[name] = true
+	return nil
 }
 
-func (e *Environment) Set(name, val string) {
+// Pin sets the named variable of e and makes it readonly, even if it is
+// readonly already. It is meant for the variables which the operator of the
+// shell configures and scripts cannot change.
+func (e *Environment) Pin(name, val string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.quota.add(len(name) + len(val) - e.sizeOf(name)); err != nil {
+		return err
+	}
 	if e.store == nil {
 		e.store = map[string]string{}
 	}
+	if e.readonly == nil {
+		e.readonly = map[string]bool{}
+	}
+	delete(e.lists, name)
 	e.store[name] = val
+	e.readonly[name] = true
+	e.modified = true
+	return nil
+}
+
+func errReadonly(name string) error {
+	return fmt.Errorf("%s: readonly variable", name)
+}
+
+// Set sets the named variable of e. It is an error if the variable is
+// readonly, even in the outer environments.
+func (e *Environment) Set(name, val string) error {
+	if e.IsReadonly(name) {
+		return errReadonly(name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.quota.add(len(name) + len(val) - e.sizeOf(name)); err != nil {
+		return err
+	}
+	if e.store == nil {
+		e.store = map[string]string{}
+	}
+	delete(e.lists, name)
+	e.store[name] = val
+	e.modified = true
+	return nil
+}
+
+// SetList is like Set but sets the named variable to a list of vals.
+func (e *Environment) SetList(name string, vals []string) error {
+	if e.IsReadonly(name) {
+		return errReadonly(name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.quota.add(len(name) + listSize(vals) - e.sizeOf(name)); err != nil {
+		return err
+	}
+	if e.lists == nil {
+		e.lists = map[string][]string{}
+	}
+	delete(e.store, name)
+	e.lists[name] = append([]string{}, vals...)
+	e.modified = true
+	return nil
+}
+
+// Unset removes the named variable from e, not from the outer environments.
+// It is an error if the variable is readonly.
+func (e *Environment) Unset(name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, inStore := e.store[name]
+	_, inLists := e.lists[name]
+	if !inStore && !inLists {
+		return nil
+	}
+	if e.readonly[name] {
+		return errReadonly(name)
+	}
+	e.quota.add(-e.sizeOf(name))
+	delete(e.store, name)
+	delete(e.lists, name)
+	e.modified = true
+	return nil
+}
+
+// Names returns the sorted names of the variables in e, not including the
+// outer environments.
+func (e *Environment) Names() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	names := make([]string, 0, len(e.store)+len(e.lists))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	for name := range e.lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshot returns copies of the variables of e.
+func (e *Environment) snapshot() (map[string]string, map[string][]string) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	store := make(map[string]string, len(e.store))
+	for name, val := range e.store {
+		store[name] = val
+	}
+	lists := make(map[string][]string, len(e.lists))
+	for name, list := range e.lists {
+		lists[name] = list
+	}
+	return store, lists
+}
+
+// takeModified reports whether e has been modified since the last call,
+// and clears the flag.
+func (e *Environment) takeModified() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	modified := e.modified
+	e.modified = false
+	return modified
+}
+
+func (e *Environment) markModified() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.modified = true
 }
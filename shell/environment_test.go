@@ -34,3 +34,101 @@ func TestEnvironment(t *testing.T) {
 		assert.Equal(t, tt.exists, exists)
 	}
 }
+
+func TestEnvironmentList(t *testing.T) {
+	topLevel := &Environment{}
+	topLevel.SetList("xs", []string{"a", "b"})
+	topLevel.Set("s", "a b")
+	localEnv := &Environment{
+		outer: topLevel,
+	}
+	localEnv.Set("xs", "shadowed")
+
+	for _, tt := range []struct {
+		env    *Environment
+		name   string
+		val    string
+		list   []string
+		isList bool
+	}{
+		{topLevel, "xs", "a b", []string{"a", "b"}, true},
+		{topLevel, "s", "a b", []string{"a b"}, false},
+		{localEnv, "xs", "shadowed", []string{"shadowed"}, false},
+		{localEnv, "s", "a b", []string{"a b"}, false},
+		{localEnv, "y", "", nil, false},
+	} {
+		val, _ := tt.env.Get(tt.name)
+		list, _ := tt.env.GetList(tt.name)
+		assert.Equal(t, tt.val, val, "name=%q", tt.name)
+		assert.Equal(t, tt.list, list, "name=%q", tt.name)
+		assert.Equal(t, tt.isList, tt.env.IsList(tt.name), "name=%q", tt.name)
+	}
+
+	topLevel.Set("xs", "c")
+	assert.False(t, topLevel.IsList("xs"))
+	topLevel.SetList("s", nil)
+	list, ok := topLevel.GetList("s")
+	assert.True(t, ok)
+	assert.Empty(t, list)
+}
+
+func TestEnvironmentUnset(t *testing.T) {
+	outer := &Environment{}
+	outer.Set("x", "outer")
+	env := &Environment{
+		outer: outer,
+	}
+	env.Set("x", "inner")
+	env.SetList("xs", []string{"a"})
+
+	assert.Equal(t, []string{"x", "xs"}, env.Names())
+	assert.Nil(t, env.Unset("x"))
+	assert.Nil(t, env.Unset("xs"))
+	assert.Nil(t, env.Unset("x"))
+	assert.Empty(t, env.Names())
+
+	val, ok := env.Get("x")
+	assert.True(t, ok)
+	assert.Equal(t, "outer", val)
+}
+
+func TestEnvironmentReadonly(t *testing.T) {
+	outer := &Environment{}
+	outer.Set("x", "pinned")
+	outer.SetList("xs", []string{"a"})
+	env := &Environment{
+		outer: outer,
+	}
+
+	assert.Nil(t, outer.SetReadonly("x"))
+	assert.Nil(t, outer.SetReadonly("xs"))
+	assert.EqualError(t, outer.SetReadonly("y"), "y: not set")
+	assert.True(t, env.IsReadonly("x"))
+	assert.False(t, env.IsReadonly("y"))
+
+	for _, err := range []error{
+		outer.Set("x", "changed"),
+		env.Set("x", "shadowed"),
+		env.SetList("x", nil),
+		outer.SetList("xs", []string{"b"}),
+		outer.Unset("x"),
+	} {
+		assert.EqualError(t, err, err.Error())
+		assert.Contains(t, err.Error(), ": readonly variable")
+	}
+	val, _ := env.Get("x")
+	assert.Equal(t, "pinned", val)
+	list, _ := env.GetList("xs")
+	assert.Equal(t, []string{"a"}, list)
+
+	assert.Nil(t, env.Set("y", "free"))
+
+	assert.Nil(t, outer.Pin("x", "repinned"))
+	assert.Nil(t, outer.Pin("xs", "string"))
+	assert.Nil(t, outer.Pin("z", "new"))
+	val, _ = env.Get("xs")
+	assert.Equal(t, "string", val)
+	assert.False(t, env.IsList("xs"))
+	assert.True(t, env.IsReadonly("z"))
+	assert.NotNil(t, outer.Set("x", "changed"))
+}
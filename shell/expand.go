@@ -1,12 +1,56 @@
 package shell
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
-	"unicode"
 )
 
+// expander expands a single word.
+type expander struct {
+	// ctx stops long expansions when it is done.
+	ctx context.Context
+	env *Environment
+	// quota is the memory limit of the script, which the expanded word
+	// must fit in.
+	quota *quota
+
+	// param resolves special parameters such as $? before env is
+	// consulted, and list resolves those whose value is a list such as $@.
+	param func(name string) (string, bool)
+	list  func(name string) ([]string, bool)
+
+	// substs are the parsed command substitutions of the word which are
+	// not expanded yet, and subst runs one of them returning its output.
+	substs []*SubstNode
+	subst  func(prog *Program) (string, error)
+
+	// heredoc is set while expanding the body of a here-document, where a
+	// backslash escapes only `$` and another backslash and is kept before
+	// the other characters.
+	heredoc bool
+	// pattern is set while expanding a pattern for matchGlob, where the
+	// escaped characters are kept escaped.
+	pattern bool
+}
+
 func expand(env *Environment, s string) (string, error) {
+	x := &expander{ctx: context.Background(), env: env}
+	return x.expand(s)
+}
+
+func expandFields(env *Environment, s string) ([]string, error) {
+	x := &expander{ctx: context.Background(), env: env}
+	return x.expandFields(s)
+}
+
+func expandDollar(env *Environment, src string) (string, error) {
+	x := &expander{ctx: context.Background(), env: env}
+	return x.expandDollar(src)
+}
+
+func (x *expander) expand(s string) (string, error) {
 	needsExpand := strings.ContainsAny(s, `$"'\`)
 	if !needsExpand {
 		return s, nil
@@ -19,14 +63,12 @@ func expand(env *Environment, s string) (string, error) {
 
 	case '"':
 		s = s[1 : len(s)-1]
-		s = expandEscape(s)
-		s, err = expandDollar(env, s)
+		s, err = x.expandDollar(s)
 		if err != nil {
 			return "", err
 		}
 	default:
-		s = expandEscape(s)
-		s, err = expandDollar(env, s)
+		s, err = x.expandDollar(s)
 		if err != nil {
 			return "", err
 		}
@@ -34,52 +76,319 @@ func expand(env *Environment, s string) (string, error) {
 	return s, nil
 }
 
-func expandDollar(env *Environment, src string) (string, error) {
-	builder := strings.Builder{}
+// expandFields is like expand but splits the word into fields at the
+// elements of list variables unless the word is quoted. A word consisting of
+// nothing but empty lists has no fields.
+func (x *expander) expandFields(s string) ([]string, error) {
+	if s == "" || s[0] == '\'' || s[0] == '"' {
+		s, err := x.expand(s)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	return x.expandDollarFields(s, true)
+}
+
+// expandPattern is like expand but returns a pattern for matchGlob, in which
+// the quoted and escaped characters of s are literal while the values of the
+// unquoted parameters are patterns.
+func (x *expander) expandPattern(s string) (string, error) {
+	if s != "" && (s[0] == '\'' || s[0] == '"') {
+		s, err := x.expand(s)
+		if err != nil {
+			return "", err
+		}
+		return escapeGlob(s), nil
+	}
+	x.pattern = true
+	defer func() {
+		x.pattern = false
+	}()
+	return x.expandDollar(s)
+}
+
+func (x *expander) expandDollar(src string) (string, error) {
+	fields, err := x.expandDollarFields(src, false)
+	if err != nil {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+// expandDollarFields expands the parameters, command substitutions and
+// arithmetic in src, and removes the backslashes which escape characters.
+func (x *expander) expandDollarFields(src string, split bool) ([]string, error) {
+	w := newFieldWriter(split)
+	w.quota = x.quota
 	for len(src) > 0 {
-		index := strings.IndexRune(src, '$')
+		if w.err != nil {
+			return nil, w.err
+		}
+		index := strings.IndexAny(src, `$\`)
 		if index < 0 {
 			break
 		}
-		builder.WriteString(src[:index])
+		if index > 0 {
+			w.WriteString(src[:index])
+		}
+		if src[index] == '\\' {
+			src = src[index+1:]
+			if len(src) == 0 || x.heredoc && src[0] != '$' && src[0] != '\\' {
+				w.WriteString(`\`)
+				continue
+			}
+			if x.pattern {
+				w.WriteString(escapeGlob(src[:1]))
+			} else {
+				w.WriteString(src[:1])
+			}
+			src = src[1:]
+			continue
+		}
 		src = src[index+1:]
+		if len(src) == 0 {
+			w.WriteString("$")
+			break
+		}
 		var name string
-		if src[0] == '{' {
-			last := strings.IndexRune(src, '}')
+		if src[0] == '(' {
+			last := matchParen(src)
 			if last < 0 {
-				return "", fmt.Errorf("unbalanced {")
+				return nil, fmt.Errorf("unbalanced (")
 			}
-			name = src[1:last]
-			src = src[last+1:]
-		} else {
-			last := strings.IndexFunc(src, func(ch rune) bool {
-				if unicode.IsSpace(ch) {
-					return true
-				}
-				switch ch {
-				case '$', '\'', '"':
-					return true
+			paren := src[:last]
+			src = src[last:]
+			if isArith(paren) {
+				n, err := x.arith(paren[1 : len(paren)-1])
+				if err != nil {
+					return nil, err
 				}
-				return false
-			})
+				w.WriteString(strconv.FormatInt(n, 10))
+				continue
+			}
+			out, err := x.substitute()
+			if err != nil {
+				return nil, err
+			}
+			w.WriteString(out)
+			continue
+		} else if src[0] == '{' {
+			last := matchBrace(src)
 			if last < 0 {
-				last = len(src)
+				return nil, fmt.Errorf("unbalanced {")
+			}
+			expr := src[1 : last-1]
+			src = src[last:]
+			if name, op := splitParamName(expr); name != "" && op == "" {
+				x.writeParam(w, name)
+				continue
+			}
+			val, err := x.expandParam(expr)
+			if err != nil {
+				return nil, err
+			}
+			w.WriteString(val)
+			continue
+		} else if isSpecialParam(src[0]) || isDigit(src[0]) {
+			name = src[:1]
+			src = src[1:]
+		} else {
+			last := 0
+			for last < len(src) && (isNameStart(src[last]) || isDigit(src[last])) {
+				last++
+			}
+			if last == 0 {
+				// not a parameter
+				w.WriteString("$")
+				continue
 			}
 			name = src[:last]
 			src = src[last:]
+			if len(src) > 0 && src[0] == '[' {
+				if last := matchBracket(src, '[', ']'); last > 0 {
+					val, _, err := x.index(name, src[1:last-1])
+					if err != nil {
+						return nil, err
+					}
+					w.WriteString(val)
+					src = src[last:]
+					continue
+				}
+			}
 		}
-		val, _ := env.Get(name)
-		builder.WriteString(val)
+		x.writeParam(w, name)
 	}
-	builder.WriteString(src)
-	return builder.String(), nil
+	if len(src) > 0 {
+		w.WriteString(src)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.Fields(), nil
+}
+
+// fieldWriter collects the fields of an expanded word. The elements of a
+// list start new fields if split is true, and are joined with spaces
+// otherwise. Writing stops with err once the fields do not fit in quota.
+type fieldWriter struct {
+	fields []string
+	last   strings.Builder
+	split  bool
+	// bare is true while nothing but empty lists has been written.
+	bare bool
+
+	quota *quota
+	size  int
+	err   error
+}
+
+func newFieldWriter(split bool) *fieldWriter {
+	return &fieldWriter{
+		split: split,
+		bare:  true,
+	}
+}
+
+func (w *fieldWriter) WriteString(s string) {
+	if w.err != nil {
+		return
+	}
+	w.size += len(s)
+	if w.err = w.quota.check(w.size); w.err != nil {
+		return
+	}
+	w.last.WriteString(s)
+	w.bare = false
+}
+
+func (w *fieldWriter) WriteList(list []string) {
+	if !w.split {
+		w.WriteString(strings.Join(list, " "))
+		return
+	}
+	for i, s := range list {
+		if i > 0 {
+			w.fields = append(w.fields, w.last.String())
+			w.last.Reset()
+		}
+		w.WriteString(s)
+	}
+}
+
+func (w *fieldWriter) Fields() []string {
+	if w.bare && w.split {
+		return nil
+	}
+	return append(w.fields, w.last.String())
+}
+
+// writeParam writes the value of the named parameter, which is split into
+// fields if it is a list.
+func (x *expander) writeParam(w *fieldWriter, name string) {
+	list, ok := x.lookupList(name)
+	if !ok {
+		w.WriteString("")
+		return
+	}
+	w.WriteList(list)
+}
+
+// isSpecialParam reports whether ch names a special parameter such as $?.
+func isSpecialParam(ch byte) bool {
+	return strings.IndexByte("?$#@*", ch) >= 0
+}
+
+func (x *expander) lookup(name string) string {
+	val, _ := x.lookupOK(name)
+	return val
+}
+
+// lookupOK is like lookup but also reports whether the parameter is set.
+func (x *expander) lookupOK(name string) (string, bool) {
+	if x.param != nil {
+		if val, ok := x.param(name); ok {
+			return val, ok
+		}
+	}
+	return x.env.Get(name)
+}
+
+// lookupList returns the elements of the named parameter, which are the
+// value itself if it is not a list.
+func (x *expander) lookupList(name string) ([]string, bool) {
+	if x.list != nil {
+		if list, ok := x.list(name); ok {
+			return list, ok
+		}
+	}
+	if x.param != nil {
+		if val, ok := x.param(name); ok {
+			return []string{val}, ok
+		}
+	}
+	return x.env.GetList(name)
+}
+
+// isList reports whether the named parameter is a list.
+func (x *expander) isList(name string) bool {
+	if x.list != nil {
+		if _, ok := x.list(name); ok {
+			return true
+		}
+	}
+	return x.env.IsList(name)
+}
+
+// index returns the element of the named parameter at the position given by
+// the arithmetic expression expr. Positions start at 1, and negative ones
+// count from the end. It also reports whether there is such an element.
+func (x *expander) index(name, expr string) (string, bool, error) {
+	n, err := x.arith(expr)
+	if err != nil {
+		return "", false, err
+	}
+	list, _ := x.lookupList(name)
+	if n < 0 {
+		n += int64(len(list)) + 1
+	}
+	if n < 1 || n > int64(len(list)) {
+		return "", false, nil
+	}
+	return list[n-1], true, nil
+}
+
+// arith evaluates the body of an arithmetic expansion. The body may refer
+// to parameters with `$` and contain command substitutions as well.
+func (x *expander) arith(expr string) (int64, error) {
+	expr, err := x.expandDollar(expr)
+	if err != nil {
+		return 0, err
+	}
+	return evalArith(x.env, expr)
+}
+
+// substitute runs the next command substitution and returns its output
+// without trailing newlines.
+func (x *expander) substitute() (string, error) {
+	if len(x.substs) == 0 || x.subst == nil {
+		return "", fmt.Errorf("bad command substitution")
+	}
+	node := x.substs[0]
+	x.substs = x.substs[1:]
+	out, err := x.subst(node.Prog)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out, "\n"), nil
 }
 
 func expandEscape(src string) string {
 	builder := strings.Builder{}
 	for len(src) > 0 {
 		index := strings.IndexRune(src, '\\')
-		if index < 0 {
+		if index < 0 || index == len(src)-1 {
+			// a trailing backslash escapes nothing and is kept
 			break
 		}
 		builder.WriteString(src[:index])
@@ -89,3 +398,92 @@ func expandEscape(src string) string {
 	builder.WriteString(src)
 	return builder.String()
 }
+
+// findSubsts returns the bodies of the command substitutions in the literal
+// of a word, in order of appearance.
+func findSubsts(lit string) []string {
+	if strings.HasPrefix(lit, "'") {
+		return nil
+	}
+	return scanSubsts(lit)
+}
+
+// scanSubsts returns the bodies of the command substitutions in s
+// regardless of quotes around s. `$(` escaped with a backslash is not a
+// command substitution.
+func scanSubsts(s string) []string {
+	lit := s
+	var substs []string
+	for {
+		index := strings.IndexAny(lit, `$\`)
+		if index < 0 || index+1 >= len(lit) {
+			break
+		}
+		switch {
+		case lit[index] == '\\' || lit[index+1] == '$':
+			// `\x` escapes x, and `$$` is a parameter
+			lit = lit[index+2:]
+			continue
+		case lit[index+1] != '(':
+			lit = lit[index+1:]
+			continue
+		}
+		lit = lit[index+1:]
+		last := matchParen(lit)
+		if last < 0 {
+			break
+		}
+		if paren := lit[:last]; isArith(paren) {
+			// the body may contain command substitutions
+			lit = lit[2:]
+			continue
+		}
+		substs = append(substs, lit[1:last-1])
+		lit = lit[last:]
+	}
+	return substs
+}
+
+// isArith reports whether the parenthesized text following `$` is an
+// arithmetic expansion $((...)) rather than a command substitution.
+func isArith(paren string) bool {
+	return strings.HasPrefix(paren, "((") && strings.HasSuffix(paren, "))")
+}
+
+// matchParen returns the length of the parenthesized text at the start of
+// s, including both parentheses, or -1 if they are unbalanced. Parentheses
+// within quotes are ignored.
+func matchParen(s string) int {
+	return matchBracket(s, '(', ')')
+}
+
+// matchBrace is like matchParen but for a text in braces.
+func matchBrace(s string) int {
+	return matchBracket(s, '{', '}')
+}
+
+func matchBracket(s string, open, close byte) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == open:
+			depth++
+		case ch == close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
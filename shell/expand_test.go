@@ -1,6 +1,8 @@
 package shell
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,6 +29,11 @@ func TestExpand(t *testing.T) {
 			nil,
 			"hello world",
 		},
+		{
+			`cost:\ \$5\\`,
+			nil,
+			`cost: $5\`,
+		},
 	} {
 		env := &Environment{}
 		result, err := expand(env, tt.input)
@@ -52,6 +59,10 @@ func TestExpandEscape(t *testing.T) {
 			"first\\\nsecond\\\n",
 			"first\nsecond\n",
 		},
+		{
+			`a\`,
+			`a\`,
+		},
 	} {
 		assert.Equal(t, tt.expected, expandEscape(tt.input))
 	}
@@ -92,6 +103,11 @@ func TestExpandDollar(t *testing.T) {
 			},
 			"12 3 4",
 		},
+		{
+			"cost: 5$",
+			nil,
+			"cost: 5$",
+		},
 	} {
 		env := &Environment{
 			store: tt.store,
@@ -101,3 +117,201 @@ func TestExpandDollar(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestFindSubsts(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected []string
+	}{
+		{"hello", nil},
+		{"$(echo hello)", []string{"echo hello"}},
+		{`"a $(echo b) $(echo c | cat)"`, []string{"echo b", "echo c | cat"}},
+		{"$(echo $(echo nested))", []string{"echo $(echo nested)"}},
+		{`$(echo ")")`, []string{`echo ")"`}},
+		{"'$(echo quoted)'", nil},
+		{"$((1 + 2)) $(echo a)", []string{"echo a"}},
+		{"$(($(echo 1) + $((2 * $(echo 3))))) $(echo a)", []string{"echo 1", "echo 3", "echo a"}},
+		{"$(echo unbalanced", nil},
+		{`\$(echo escaped) $(echo a)`, []string{"echo a"}},
+		{`"\\$(echo a) \$(echo escaped)"`, []string{"echo a"}},
+		{`$$(echo pid) $\$(echo escaped)`, nil},
+	} {
+		assert.Equal(t, tt.expected, findSubsts(tt.input), "input=%q", tt.input)
+	}
+}
+
+func TestExpandParam(t *testing.T) {
+	env := &Environment{
+		store: map[string]string{
+			"x":     "hello",
+			"empty": "",
+			"path":  "/usr/local/bin/ghost.tar.gz",
+			"jp":    "こんにちは",
+			"n":     "2",
+		},
+	}
+
+	for _, tt := range []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{"${x}", "hello", ""},
+		{"${x}world", "helloworld", ""},
+		{"${unset:-default}", "default", ""},
+		{"${empty:-default}", "default", ""},
+		{"${empty-default}", "", ""},
+		{"${x:-default}", "hello", ""},
+		{"${unset:-$x world}", "hello world", ""},
+		{`${unset:-"a b"}`, "a b", ""},
+		{"${unset:-${x:-nested}}", "hello", ""},
+		{"${x:+alt}", "alt", ""},
+		{"${empty:+alt}", "", ""},
+		{"${empty+alt}", "alt", ""},
+		{"${unset+alt}", "", ""},
+		{"${#x}", "5", ""},
+		{"${#jp}", "5", ""},
+		{"${#unset}", "0", ""},
+		{"${path#*/}", "usr/local/bin/ghost.tar.gz", ""},
+		{"${path##*/}", "ghost.tar.gz", ""},
+		{"${path%.*}", "/usr/local/bin/ghost.tar", ""},
+		{"${path%%.*}", "/usr/local/bin/ghost", ""},
+		{"${path%/*}", "/usr/local/bin", ""},
+		{"${x#nomatch}", "hello", ""},
+		{"${x:1}", "ello", ""},
+		{"${x:1:3}", "ell", ""},
+		{"${x:n:n+1}", "llo", ""},
+		{"${x: -3}", "llo", ""},
+		{"${x:1:-1}", "ell", ""},
+		{"${x:10}", "", ""},
+		{"${jp:1:2}", "んに", ""},
+		{"${x/l/L}", "heLlo", ""},
+		{"${x//l/L}", "heLLo", ""},
+		{"${x/l*/p}", "hep", ""},
+		{"${x/[eo]}", "hllo", ""},
+		{"${path//o/0}", "/usr/l0cal/bin/gh0st.tar.gz", ""},
+		{"${x//}", "hello", ""},
+		{"${x//?/.}", ".....", ""},
+		{"${x//l*/}", "he", ""},
+		{"${x%l*}", "hel", ""},
+		{"${x%%l*}", "he", ""},
+		{"${path/l*o/X}", "/usr/Xst.tar.gz", ""},
+		{`${path//\//-}`, "-usr-local-bin-ghost.tar.gz", ""},
+		{`${path/\/usr\//~\/}`, "~/local/bin/ghost.tar.gz", ""},
+		{"${jp#*ん}", "にちは", ""},
+		{"${jp%ち*}", "こんに", ""},
+		{"${unset:?}", "", "unset: parameter null or not set"},
+		{"${empty:?is required}", "", "empty: is required"},
+		{"${x:?is required}", "hello", ""},
+		{"${x:3:-3}", "", "-3: substring expression < 0"},
+		{"${x:1/0}", "", "division by zero"},
+		{"${}", "", "${}: bad substitution"},
+		{"${x!}", "", "${x!}: bad substitution"},
+		{"${#x:-1}", "", "${#x:-1}: bad substitution"},
+		{"${x", "", "unbalanced {"},
+	} {
+		result, err := expand(env, tt.input)
+		if tt.err != "" {
+			if assert.NotNil(t, err, "input=%q", tt.input) {
+				assert.Equal(t, tt.err, err.Error(), "input=%q", tt.input)
+			}
+			continue
+		}
+		assert.Nil(t, err, "input=%q", tt.input)
+		assert.Equal(t, tt.expected, result, "input=%q", tt.input)
+	}
+
+	result, err := expand(env, "${y:=assigned}")
+	assert.Nil(t, err)
+	assert.Equal(t, "assigned", result)
+	val, _ := env.Get("y")
+	assert.Equal(t, "assigned", val)
+}
+
+func TestExpandParamLarge(t *testing.T) {
+	// every operator has to be about linear in the length of the value
+	val := strings.Repeat("ab", 50000)
+	for _, tt := range []struct {
+		f        func(context.Context, string) (string, error)
+		expected string
+	}{
+		{
+			func(ctx context.Context, s string) (string, error) {
+				return replacePattern(ctx, nil, s, "b", "c", true)
+			},
+			strings.Repeat("ac", 50000),
+		},
+		{
+			func(ctx context.Context, s string) (string, error) {
+				return replacePattern(ctx, nil, s, "a*c", "", true)
+			},
+			val,
+		},
+		{
+			func(ctx context.Context, s string) (string, error) { return removePrefix(ctx, s, "*b", true) },
+			"",
+		},
+		{
+			func(ctx context.Context, s string) (string, error) { return removePrefix(ctx, s, "*b", false) },
+			val[2:],
+		},
+		{
+			func(ctx context.Context, s string) (string, error) { return removeSuffix(ctx, s, "a*", true) },
+			"",
+		},
+		{
+			func(ctx context.Context, s string) (string, error) { return removeSuffix(ctx, s, "a*", false) },
+			val[:len(val)-2],
+		},
+	} {
+		result, err := tt.f(context.Background(), val)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, result)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = tt.f(ctx, val)
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+func TestExpandFields(t *testing.T) {
+	env := &Environment{
+		store: map[string]string{
+			"s": "a b",
+		},
+	}
+	env.SetList("xs", []string{"x", "y z"})
+	env.SetList("empty", nil)
+
+	for _, tt := range []struct {
+		input    string
+		expected []string
+	}{
+		{"plain", []string{"plain"}},
+		{"$s", []string{"a b"}},
+		{"$xs", []string{"x", "y z"}},
+		{"${xs}", []string{"x", "y z"}},
+		{"<$xs>", []string{"<x", "y z>"}},
+		{"$xs$xs", []string{"x", "y zx", "y z"}},
+		{`"$xs"`, []string{"x y z"}},
+		{"'$xs'", []string{"$xs"}},
+		{"$xs[2]", []string{"y z"}},
+		{"$xs[-2]", []string{"x"}},
+		{"$xs[3]", []string{""}},
+		{"$s[1]", []string{"a b"}},
+		{"${#xs}", []string{"2"}},
+		{"${#s}", []string{"3"}},
+		{"${xs[2]#y }", []string{"z"}},
+		{"$empty", nil},
+		{"$empty$empty", nil},
+		{"${empty}", nil},
+		{"[$empty]", []string{"[]"}},
+		{`"$empty"`, []string{""}},
+		{"$unset", []string{""}},
+	} {
+		result, err := expandFields(env, tt.input)
+		assert.Nil(t, err, "input=%q", tt.input)
+		assert.Equal(t, tt.expected, result, "input=%q", tt.input)
+	}
+}
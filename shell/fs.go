@@ -0,0 +1,89 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// FileSystem stores the files which scripts read and write with
+// redirections. It is not necessarily backed by the host's filesystem.
+type FileSystem interface {
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+	// Create truncates or creates the named file and opens it for writing.
+	Create(name string) (io.WriteCloser, error)
+	// Append opens the named file for writing at the end, creating it if
+	// it does not exist.
+	Append(name string) (io.WriteCloser, error)
+}
+
+// MemFS is a FileSystem which keeps files in memory. It is safe for
+// concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// quota bounds the total size of files if not nil, which is set by
+	// Shell.Init.
+	quota *quota
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: map[string][]byte{},
+	}
+}
+
+func (fs *MemFS) Open(name string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such file", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fs *MemFS) Create(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.quota.add(-len(fs.files[name]))
+	fs.files[name] = []byte{}
+	return &memFile{fs: fs, name: name}, nil
+}
+
+func (fs *MemFS) Append(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; !ok {
+		fs.files[name] = []byte{}
+	}
+	return &memFile{fs: fs, name: name}, nil
+}
+
+// memFile appends everything written to it to a file of a MemFS. Writing
+// fails with a LimitError if the files would exceed the quota.
+type memFile struct {
+	fs   *MemFS
+	name string
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.fs.quota.add(len(p)); err != nil {
+		return 0, err
+	}
+	f.fs.files[f.name] = append(f.fs.files[f.name], p...)
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
@@ -0,0 +1,28 @@
+package shell
+
+// function is a command defined by a script with the function keyword.
+type function struct {
+	name string
+	body *BlockNode
+}
+
+func (fn *function) Run(ctx *ExecContext, args []string) int {
+	sh := ctx.Shell
+	if !sh.enter(ctx) {
+		return sh.status
+	}
+	defer sh.leave()
+
+	env := ctx.Env.child()
+	defer env.release()
+	local := ctx.WithEnv(env)
+	local.Args = args[1:]
+	local.inFunction = true
+
+	sh.status = 0
+	sh.Eval(local, fn.body)
+	if sh.flow == flowReturn {
+		sh.flow = flowNone
+	}
+	return sh.status
+}
@@ -0,0 +1,252 @@
+package shell
+
+import (
+	"context"
+	"strings"
+)
+
+// matchGlob reports whether s matches the shell pattern. `*` matches any
+// string, `?` matches any single character and `[...]` matches any single
+// character in the set, which may contain ranges like `a-z` and be negated
+// by a leading `!` or `^`. A backslash makes the next character literal.
+func matchGlob(pattern, s string) bool {
+	matched, _ := compileGlob(pattern).match(context.Background(), []rune(s))
+	return matched
+}
+
+// glob is a compiled shell pattern. It is matched by simulating it as a
+// nondeterministic automaton, whose state i means that the first i tokens
+// have matched, so that the matches ending at every position of a string
+// are found in a single pass over it.
+type glob []globToken
+
+type globToken struct {
+	// kind is '*', '?' or '[', or 0 for the literal character ch.
+	kind  rune
+	ch    rune
+	class []rune // the bracket expression of '['
+}
+
+func compileGlob(pattern string) glob {
+	p := []rune(pattern)
+	var g glob
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*', '?':
+			g = append(g, globToken{kind: p[i]})
+			continue
+		case '[':
+			if _, n := matchClass(p[i:], 0); n > 0 {
+				g = append(g, globToken{kind: '[', class: p[i : i+n]})
+				i += n - 1
+				continue
+			}
+			// an unclosed [ is an ordinary character
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+		}
+		g = append(g, globToken{ch: p[i]})
+	}
+	return g
+}
+
+func (t globToken) match(ch rune) bool {
+	switch t.kind {
+	case '*', '?':
+		return true
+	case '[':
+		matched, _ := matchClass(t.class, ch)
+		return matched
+	}
+	return t.ch == ch
+}
+
+// reverse returns the pattern which matches the reversed strings.
+func (g glob) reverse() glob {
+	r := make(glob, len(g))
+	for i, t := range g {
+		r[len(g)-1-i] = t
+	}
+	return r
+}
+
+// checkInterval is the number of characters which matching goes through
+// between checks whether the context is done, since matching a large string
+// against a long pattern can take a while.
+const checkInterval = 1024
+
+// match reports whether s matches g. It fails with the error of ctx when
+// ctx is done.
+func (g glob) match(ctx context.Context, s []rune) (bool, error) {
+	matched := false
+	err := g.matchPrefixes(ctx, s, func(n int) bool {
+		matched = n == len(s)
+		return true
+	})
+	return matched, err
+}
+
+// threads holds the start of the match in progress in each state of a glob,
+// which is the leftmost one if there are several, or -1 if the state is not
+// active.
+type threads []int
+
+func (g glob) threads() threads {
+	t := make(threads, len(g)+1)
+	t.clear()
+	return t
+}
+
+func (t threads) clear() {
+	for i := range t {
+		t[i] = -1
+	}
+}
+
+// alive reports whether any state is active.
+func (t threads) alive() bool {
+	for _, start := range t {
+		if start >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// add activates the state i for the match from start, and the states which
+// follow it through stars, which may match nothing.
+func (g glob) add(t threads, i, start int) {
+	for {
+		if t[i] >= 0 && t[i] <= start {
+			return
+		}
+		t[i] = start
+		if i == len(g) || g[i].kind != '*' {
+			return
+		}
+		i++
+	}
+}
+
+// step advances the matches in t by ch into next.
+func (g glob) step(t, next threads, ch rune) {
+	next.clear()
+	for i, start := range t[:len(g)] {
+		if start < 0 || !g[i].match(ch) {
+			continue
+		}
+		if g[i].kind == '*' {
+			g.add(next, i, start)
+		} else {
+			g.add(next, i+1, start)
+		}
+	}
+}
+
+// matchPrefixes calls f with the length of every prefix of s which matches
+// g, in increasing order, until f returns false. It fails with the error of
+// ctx when ctx is done.
+func (g glob) matchPrefixes(ctx context.Context, s []rune, f func(n int) bool) error {
+	t, next := g.threads(), g.threads()
+	g.add(t, 0, 0)
+	for pos := 0; ; pos++ {
+		if t[len(g)] >= 0 && !f(pos) {
+			return nil
+		}
+		if pos == len(s) || !t.alive() {
+			return nil
+		}
+		if pos%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		g.step(t, next, s[pos])
+		t, next = next, t
+	}
+}
+
+// find returns the start and the end of the leftmost longest match of g in
+// s from the position from, which is not empty. The start is -1 if there is
+// no match. It fails with the error of ctx when ctx is done.
+func (g glob) find(ctx context.Context, s []rune, from int) (int, int, error) {
+	t, next := g.threads(), g.threads()
+	start, end := -1, -1
+	for pos := from; ; pos++ {
+		if start < 0 {
+			g.add(t, 0, pos)
+		}
+		if st := t[len(g)]; st >= 0 && st < pos && (start < 0 || st <= start) {
+			start, end = st, pos
+		}
+		if start >= 0 {
+			// the matches which start later cannot be the leftmost
+			for i, st := range t {
+				if st > start {
+					t[i] = -1
+				}
+			}
+			if !t.alive() {
+				break
+			}
+		}
+		if pos == len(s) {
+			break
+		}
+		if pos%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return -1, -1, err
+			}
+		}
+		g.step(t, next, s[pos])
+		t, next = next, t
+	}
+	return start, end, nil
+}
+
+// escapeGlob escapes the characters of s which are special to matchGlob.
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, ch := range s {
+		if strings.ContainsRune(`*?[\`, ch) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
+
+// matchClass matches ch against the bracket expression at the start of p.
+// It returns the length of the expression, which is 0 if it is not closed.
+func matchClass(p []rune, ch rune) (bool, int) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return matched != negate, i + 1
+		}
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		i++
+		hi := lo
+		if i+1 < len(p) && p[i] == '-' && p[i+1] != ']' {
+			hi = p[i+1]
+			i += 2
+		}
+		if lo <= ch && ch <= hi {
+			matched = true
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,54 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		s        string
+		expected bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"*", "", true},
+		{"*", "a/b c", true},
+		{"a*", "abc", true},
+		{"a*", "bac", false},
+		{"*c", "abc", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"**a", "bba", true},
+		{"?", "あ", true},
+		{"??", "a", false},
+		{"h?llo", "hello", true},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-c]x", "bx", true},
+		{"[!a-c]", "b", false},
+		{"[^a-c]", "d", true},
+		{"[]]", "]", true},
+		{"[a-]", "-", true},
+		{"[", "[", true},
+		{"[ab", "[ab", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"start|stop", "start", false},
+	} {
+		assert.Equal(t, tt.expected, matchGlob(tt.pattern, tt.s), "pattern=%q s=%q", tt.pattern, tt.s)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	for _, s := range []string{"", "abc", "*", "a?b", "[a-z]", `back\slash`, "あ*"} {
+		assert.True(t, matchGlob(escapeGlob(s), s), "s=%q", s)
+		assert.False(t, matchGlob(escapeGlob(s), s+"x"), "s=%q", s)
+	}
+	assert.False(t, matchGlob(escapeGlob("a*"), "abc"))
+	assert.False(t, matchGlob(escapeGlob("[a-z]"), "b"))
+}
@@ -0,0 +1,196 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// StatusLimit is the exit status of a script which is aborted because it
+// exceeds one of its Limits.
+const StatusLimit = 125
+
+// Limits bounds the resources which a script can use, so that scripts from
+// untrusted users cannot exhaust the memory. A zero field means no limit.
+type Limits struct {
+	// Steps is the number of nodes which a script can evaluate.
+	Steps int
+	// Output is the number of bytes which a script can write to Out, and
+	// to Err separately.
+	Output int
+	// Storage is the total size of the global and local variables, which
+	// is the sum of the lengths of their names and values.
+	Storage int
+	// Depth is how deeply function calls and command substitutions can
+	// be nested.
+	Depth int
+	// Memory is the number of bytes which the files of the MemFS created
+	// by Init, the pipes and command substitutions in use and the
+	// arguments of the running commands can take in total.
+	Memory int
+}
+
+// LimitError is the error of a script which exceeds one of its Limits.
+type LimitError struct {
+	Limit string
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded", err.Limit)
+}
+
+// quota bounds the total size of something, such as the variables of
+// environments, which can be shared by many users.
+type quota struct {
+	mu sync.Mutex
+	// limit names the limit in the error when max is exceeded.
+	limit string
+	max   int
+	used  int
+}
+
+// add adds n to the used size, or returns an error if it would exceed max.
+func (q *quota) add(n int) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > 0 && q.used+n > q.max {
+		return &LimitError{Limit: q.limit}
+	}
+	q.used += n
+	return nil
+}
+
+// check returns the error which add would return for n without adding it.
+func (q *quota) check(n int) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > 0 && q.used+n > q.max {
+		return &LimitError{Limit: q.limit}
+	}
+	return nil
+}
+
+// fail reports err like error, but aborts the script if err is a
+// LimitError or the context is done, which is what err is caused by then.
+func (sh *Shell) fail(ctx *ExecContext, err error) {
+	if _, ok := err.(*LimitError); ok {
+		sh.abort(err.Error(), StatusLimit)
+		return
+	}
+	if sh.aborted(ctx) {
+		return
+	}
+	sh.error(ctx, err.Error())
+}
+
+// step counts a node to be evaluated and reports whether the script can go
+// on.
+func (sh *Shell) step(ctx *ExecContext) bool {
+	sh.steps++
+	if sh.Limits.Steps > 0 && sh.steps > sh.Limits.Steps {
+		sh.fail(ctx, &LimitError{Limit: "step"})
+		return false
+	}
+	return true
+}
+
+// enter is called when a function call or a command substitution starts,
+// and reports whether it can go on. leave must be called when it ends if
+// enter reports true.
+func (sh *Shell) enter(ctx *ExecContext) bool {
+	if sh.Limits.Depth > 0 && sh.depth >= sh.Limits.Depth {
+		sh.fail(ctx, &LimitError{Limit: "recursion depth"})
+		return false
+	}
+	sh.depth++
+	return true
+}
+
+func (sh *Shell) leave() {
+	sh.depth--
+}
+
+// limitedWriter writes to w at most n bytes in total, and aborts the script
+// of sh when more are written. The rest is discarded without errors, which
+// would only repeat the abort.
+type limitedWriter struct {
+	sh *Shell
+	w  io.Writer
+	n  int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) <= lw.n {
+		n, err := lw.w.Write(p)
+		lw.n -= n
+		return n, err
+	}
+	if _, err := lw.w.Write(p[:lw.n]); err != nil {
+		return 0, err
+	}
+	lw.n = 0
+	lw.sh.abort((&LimitError{Limit: "output"}).Error(), StatusLimit)
+	return len(p), nil
+}
+
+// abortWriter writes to w, and aborts the script of sh when w returns a
+// LimitError, such as a file of a MemFS which exceeds the memory limit.
+// The rest is discarded like limitedWriter does.
+type abortWriter struct {
+	sh *Shell
+	w  io.Writer
+}
+
+func (aw *abortWriter) Write(p []byte) (int, error) {
+	n, err := aw.w.Write(p)
+	if _, ok := err.(*LimitError); ok {
+		aw.sh.abort(err.Error(), StatusLimit)
+		return len(p), nil
+	}
+	return n, err
+}
+
+// buffer is a pipe or the output of a command substitution, whose contents
+// are counted against the memory limit of sh until release is called.
+// Writing more than the limit allows aborts the script.
+type buffer struct {
+	sh   *Shell
+	buf  bytes.Buffer
+	size int
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	if err := b.sh.memory.add(len(p)); err != nil {
+		b.sh.abort(err.Error(), StatusLimit)
+		return len(p), nil
+	}
+	b.size += len(p)
+	return b.buf.Write(p)
+}
+
+func (b *buffer) Read(p []byte) (int, error) {
+	return b.buf.Read(p)
+}
+
+func (b *buffer) String() string {
+	return b.buf.String()
+}
+
+// release gives the memory which b has taken back. b must not be used
+// after that.
+func (b *buffer) release() {
+	if b == nil {
+		return
+	}
+	b.sh.memory.add(-b.size)
+	b.size = 0
+}
@@ -0,0 +1,211 @@
+package shell
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellLimits(t *testing.T) {
+	for _, tt := range []struct {
+		limits Limits
+		script string
+		stdout string
+		stderr string
+	}{
+		{
+			Limits{Steps: 20},
+			`echo start; while test 1; end; echo never`,
+			"start\n",
+			"ghost: step limit exceeded\n",
+		},
+		{
+			Limits{Steps: 20},
+			`for i in 1 2 3; echo $i; end`,
+			"1\n2\n3\n",
+			"",
+		},
+		{
+			Limits{Output: 10},
+			`echo 12345; echo 67890; echo never`,
+			"12345\n6789",
+			"ghost: output limit exceeded\n",
+		},
+		{
+			Limits{Output: 10},
+			`echo $(echo 1234567890 1234567890) | cat > file; cat file | cat`,
+			"1234567890",
+			"ghost: output limit exceeded\n",
+		},
+		{
+			Limits{Output: 30},
+			`echo ok; while test 1; nope; end`,
+			"ok\n",
+			"ghost: unknown command \"nope\"\nghost: output limit exceeded\n",
+		},
+		{
+			Limits{Memory: 30},
+			`echo 1234567890 > a; echo 1234567890 > b; echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 30},
+			`echo 1234567890 > a; echo 1234567890 > a; echo 12 >> a; cat a`,
+			"1234567890\n12\n",
+			"",
+		},
+		{
+			Limits{Memory: 30},
+			`function f; while test 1; echo 1234567890; end; end; f | cat; echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 30},
+			`echo $(while test 1; echo 1234567890; end); echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 30},
+			`function f; for i in 1 2 3; echo 123456 | cat | cat; end; end; f`,
+			"123456\n123456\n123456\n",
+			"",
+		},
+		{
+			Limits{Memory: 30},
+			`function f; for i in 1 2 3; echo 123456 | cat | cat; end; end; f | cat`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 100},
+			`set x 1234567890; echo $x$x$x$x$x$x$x$x$x$x$x; echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 100},
+			`set x 1234567890; echo $x $x $x $x $x $x $x $x $x $x; echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Memory: 50},
+			`set x 1234567890; echo ${x//?/$x}; echo never`,
+			"",
+			"ghost: memory limit exceeded\n",
+		},
+		{
+			Limits{Storage: 10},
+			`set x 12345678; set y 1; echo never`,
+			"",
+			"ghost: variable storage limit exceeded\n",
+		},
+		{
+			Limits{Storage: 10},
+			`set x 12345678; set x 1234; set y 1234; unset x; set z 1234; echo ok`,
+			"ok\n",
+			"",
+		},
+		{
+			Limits{Storage: 10},
+			`set -a xs 1234; while test 1; set -a xs $xs $xs; end`,
+			"",
+			"ghost: variable storage limit exceeded\n",
+		},
+		{
+			Limits{Storage: 10},
+			`function f; set x 12345678; end; f; f; f; echo [$(set y 12345678)] ${z:=12345678}`,
+			"[] 12345678\n",
+			"",
+		},
+		{
+			Limits{Storage: 10},
+			`echo ${z:=1234567890}; echo never`,
+			"",
+			"ghost: variable storage limit exceeded\n",
+		},
+		{
+			Limits{Depth: 3},
+			`function f; echo $1; f x$1; end; f 1; echo never`,
+			"1\nx1\nxx1\n",
+			"ghost: recursion depth limit exceeded\n",
+		},
+		{
+			Limits{Depth: 3},
+			`echo $(echo $(echo $(echo deep)))`,
+			"deep\n",
+			"",
+		},
+		{
+			Limits{Depth: 3},
+			`echo $(echo $(echo $(echo $(echo deep)))); echo never`,
+			"",
+			"ghost: recursion depth limit exceeded\n",
+		},
+	} {
+		stdout := bytes.NewBuffer(nil)
+		stderr := bytes.NewBuffer(nil)
+		sh := &Shell{
+			Out:    stdout,
+			Err:    stderr,
+			Limits: tt.limits,
+		}
+		sh.Init()
+
+		sh.Exec(tt.script)
+		assert.Equal(t, tt.stdout, stdout.String(), "script=%q", tt.script)
+		assert.Equal(t, tt.stderr, stderr.String(), "script=%q", tt.script)
+		if tt.stderr != "" {
+			assert.Equal(t, StatusLimit, sh.Status(), "script=%q", tt.script)
+		}
+
+		// the steps, output and depth are counted for each script
+		if tt.limits.Storage == 0 {
+			stdout.Reset()
+			stderr.Reset()
+			sh.Exec(`echo next`)
+			assert.Equal(t, "next\n", stdout.String(), "script=%q", tt.script)
+			assert.Equal(t, "", stderr.String(), "script=%q", tt.script)
+		}
+	}
+}
+
+func TestShellLimitMemory(t *testing.T) {
+	sh := &Shell{
+		Limits: Limits{Memory: 100},
+	}
+	sh.Init()
+
+	// only the files keep taking the memory after the scripts
+	sh.Exec(`echo 123 > a; echo $(echo 1 | cat) | cat > b; echo ${x:-$(cat a)}`)
+	assert.Equal(t, 0, sh.Status())
+	assert.Equal(t, 6, sh.memory.used)
+	sh.Exec(`function f; echo 1234567890; f; end; f | cat`)
+	assert.Equal(t, StatusLimit, sh.Status())
+	assert.Equal(t, 6, sh.memory.used)
+	sh.Exec(`echo > a; echo > b`)
+	assert.Equal(t, 2, sh.memory.used)
+}
+
+func TestEnvironmentLimitStorage(t *testing.T) {
+	env := &Environment{}
+	env.Set("x", "123")
+	env.LimitStorage(10)
+
+	assert.Nil(t, env.SetList("xs", []string{"12", "34"}))
+	assert.EqualError(t, env.Set("y", "1"), "variable storage limit exceeded")
+
+	local := env.child()
+	assert.EqualError(t, local.Set("y", "1"), "variable storage limit exceeded")
+	assert.Nil(t, env.Unset("xs"))
+	assert.Nil(t, local.Set("y", "12345"))
+	local.release()
+	assert.Nil(t, env.Set("z", "12345"))
+
+	unlimited := &Environment{}
+	assert.Nil(t, unlimited.Set("x", "12345678901234567890"))
+}
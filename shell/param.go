@@ -0,0 +1,308 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// expandParam expands the body of ${...}, which is a parameter name
+// optionally followed by an operator:
+//
+//	${x:-word}  word if x is unset or empty, x otherwise
+//	${x:=word}  like :- but also assigns word to x
+//	${x:?word}  an error with the message word if x is unset or empty
+//	${x:+word}  word if x is set and not empty, nothing otherwise
+//	${#x}       the length of x, or the number of elements if x is a list
+//	${x[i]}     the element of x at i, which may be followed by an operator
+//	${x#pat}    x without the shortest prefix matching pat (## longest)
+//	${x%pat}    x without the shortest suffix matching pat (%% longest)
+//	${x:off}    x from off, or ${x:off:len} len characters from off
+//	${x/pat/s}  x with the first match of pat replaced by s (// all)
+//
+// The operators -, =, ? and + without a colon only test whether x is set.
+func (x *expander) expandParam(expr string) (string, error) {
+	if len(expr) > 1 && expr[0] == '#' {
+		name, op := splitParamName(expr[1:])
+		if name == "" || op != "" {
+			return "", badSubstitution(expr)
+		}
+		if x.isList(name) {
+			list, _ := x.lookupList(name)
+			return strconv.Itoa(len(list)), nil
+		}
+		val, _ := x.lookupOK(name)
+		return strconv.Itoa(utf8.RuneCountInString(val)), nil
+	}
+
+	name, op := splitParamName(expr)
+	if name == "" {
+		return "", badSubstitution(expr)
+	}
+	val, set := x.lookupOK(name)
+	if strings.HasPrefix(op, "[") {
+		last := matchBracket(op, '[', ']')
+		if last < 0 {
+			return "", badSubstitution(expr)
+		}
+		var err error
+		val, set, err = x.index(name, op[1:last-1])
+		if err != nil {
+			return "", err
+		}
+		// the element cannot be assigned with :=
+		name, op = name+op[:last], op[last:]
+	}
+	if op == "" {
+		return val, nil
+	}
+
+	switch {
+	case len(op) > 1 && op[0] == ':' && strings.IndexByte("-=?+", op[1]) >= 0:
+		return x.expandDefault(name, val, set && val != "", op[1], op[2:])
+	case strings.IndexByte("-=?+", op[0]) >= 0:
+		return x.expandDefault(name, val, set, op[0], op[1:])
+	case op[0] == ':':
+		return x.substring(val, op[1:])
+	case op[0] == '#' || op[0] == '%':
+		longest := len(op) > 1 && op[1] == op[0]
+		pattern := op[1:]
+		if longest {
+			pattern = op[2:]
+		}
+		pattern, err := x.expand(pattern)
+		if err != nil {
+			return "", err
+		}
+		if op[0] == '#' {
+			return removePrefix(x.ctx, val, pattern, longest)
+		}
+		return removeSuffix(x.ctx, val, pattern, longest)
+	case op[0] == '/':
+		all := strings.HasPrefix(op, "//")
+		op = op[1:]
+		if all {
+			op = op[1:]
+		}
+		pattern, repl := op, ""
+		if index := indexUnescaped(op, '/'); index >= 0 {
+			pattern, repl = op[:index], op[index+1:]
+		}
+		pattern, err := x.expand(pattern)
+		if err != nil {
+			return "", err
+		}
+		repl, err = x.expand(repl)
+		if err != nil {
+			return "", err
+		}
+		return replacePattern(x.ctx, x.quota, val, pattern, repl, all)
+	}
+	return "", badSubstitution(expr)
+}
+
+func badSubstitution(expr string) error {
+	return fmt.Errorf("${%s}: bad substitution", expr)
+}
+
+// splitParamName splits the body of ${...} into the parameter name and the
+// rest.
+func splitParamName(expr string) (string, string) {
+	if expr == "" {
+		return "", ""
+	}
+	n := 0
+	switch {
+	case isDigit(expr[0]):
+		for n < len(expr) && isDigit(expr[n]) {
+			n++
+		}
+	case isSpecialParam(expr[0]):
+		n = 1
+	default:
+		for n < len(expr) && (isNameStart(expr[n]) || isDigit(expr[n])) {
+			n++
+		}
+	}
+	return expr[:n], expr[n:]
+}
+
+// indexUnescaped is like strings.IndexByte but skips the characters escaped
+// with a backslash.
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// expandDefault implements the operators -, =, ? and +. ok tells whether
+// the parameter counts as set for the operator.
+func (x *expander) expandDefault(name, val string, ok bool, op byte, word string) (string, error) {
+	use := !ok
+	if op == '+' {
+		use = ok
+	}
+	if !use {
+		// the substitutions in the word are never run, but they have to
+		// be consumed to keep the rest of them in order
+		x.skipSubsts(word)
+		if op == '+' {
+			return "", nil
+		}
+		return val, nil
+	}
+
+	word, err := x.expand(word)
+	if err != nil {
+		return "", err
+	}
+	switch op {
+	case '=':
+		if !isName(name) {
+			return "", fmt.Errorf("$%s: cannot assign in this way", name)
+		}
+		if err := x.env.Set(name, word); err != nil {
+			return "", err
+		}
+	case '?':
+		if word == "" {
+			word = "parameter null or not set"
+		}
+		return "", fmt.Errorf("%s: %s", name, word)
+	}
+	return word, nil
+}
+
+// skipSubsts drops the command substitutions of word which is not going to
+// be expanded.
+func (x *expander) skipSubsts(word string) {
+	n := len(scanSubsts(word))
+	if n > len(x.substs) {
+		n = len(x.substs)
+	}
+	x.substs = x.substs[n:]
+}
+
+// substring implements ${x:off} and ${x:off:len}, where off and len are
+// arithmetic expressions. A negative off counts from the end of val, and a
+// negative len tells the position of the end counting from the end.
+func (x *expander) substring(val, expr string) (string, error) {
+	s := []rune(val)
+	offExpr, lenExpr := expr, ""
+	hasLen := false
+	if index := strings.IndexByte(expr, ':'); index >= 0 {
+		offExpr, lenExpr = expr[:index], expr[index+1:]
+		hasLen = true
+	}
+
+	off, err := x.arith(offExpr)
+	if err != nil {
+		return "", err
+	}
+	if off < 0 {
+		off += int64(len(s))
+		if off < 0 {
+			off = 0
+		}
+	}
+	if off > int64(len(s)) {
+		return "", nil
+	}
+
+	end := int64(len(s))
+	if hasLen {
+		n, err := x.arith(lenExpr)
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			end += n
+		} else if off+n < end {
+			end = off + n
+		}
+		if end < off {
+			return "", fmt.Errorf("%s: substring expression < 0", lenExpr)
+		}
+	}
+	return string(s[off:end]), nil
+}
+
+// removePrefix removes the shortest or the longest prefix of val which
+// matches pattern.
+func removePrefix(ctx context.Context, val, pattern string, longest bool) (string, error) {
+	s := []rune(val)
+	n := -1
+	err := compileGlob(pattern).matchPrefixes(ctx, s, func(m int) bool {
+		n = m
+		return longest
+	})
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return val, nil
+	}
+	return string(s[n:]), nil
+}
+
+// removeSuffix is like removePrefix but removes a suffix, which is found as
+// a prefix of the reversed val.
+func removeSuffix(ctx context.Context, val, pattern string, longest bool) (string, error) {
+	s := []rune(val)
+	r := make([]rune, len(s))
+	for i, ch := range s {
+		r[len(s)-1-i] = ch
+	}
+	n := -1
+	err := compileGlob(pattern).reverse().matchPrefixes(ctx, r, func(m int) bool {
+		n = m
+		return longest
+	})
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return val, nil
+	}
+	return string(s[:len(s)-n]), nil
+}
+
+// replacePattern replaces the leftmost longest match of pattern in val with
+// repl, or every match if all is true. The result must fit in q.
+func replacePattern(ctx context.Context, q *quota, val, pattern, repl string, all bool) (string, error) {
+	if pattern == "" {
+		return val, nil
+	}
+	g := compileGlob(pattern)
+	s := []rune(val)
+	var sb strings.Builder
+	i := 0
+	for i < len(s) {
+		start, end, err := g.find(ctx, s, i)
+		if err != nil {
+			return "", err
+		}
+		if start < 0 {
+			break
+		}
+		sb.WriteString(string(s[i:start]))
+		sb.WriteString(repl)
+		if err := q.check(sb.Len()); err != nil {
+			return "", err
+		}
+		i = end
+		if !all {
+			break
+		}
+	}
+	sb.WriteString(string(s[i:]))
+	return sb.String(), nil
+}
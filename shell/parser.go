@@ -3,6 +3,8 @@ package shell
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -10,6 +12,9 @@ import (
 func Parse(r io.Reader) (prog *Program, err error) {
 	p := newParser(r)
 	defer func() {
+		if p.errors != nil {
+			p.errors.ErrorFormat = formatErrors
+		}
 		err = p.errors.ErrorOrNil()
 	}()
 
@@ -17,11 +22,23 @@ func Parse(r io.Reader) (prog *Program, err error) {
 	return
 }
 
+// formatErrors joins the errors of a parser into a single line, which fits
+// in the message of a command as well.
+func formatErrors(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
 type parser struct {
 	scanner *Scanner
 	errors  *multierror.Error
 
 	tok *Token // one token look-ahead
+
+	loopDepth int // number of enclosing loops
 }
 
 func newParser(r io.Reader) *parser {
@@ -46,6 +63,15 @@ func (p *parser) acceptKeyword(keyword string) bool {
 	return p.tok.Kind == STRING && p.tok.Literal == keyword
 }
 
+func (p *parser) acceptAnyKeyword(keywords ...string) bool {
+	for _, keyword := range keywords {
+		if p.acceptKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *parser) expect(kind TokenKind) *Token {
 	if p.tok.Kind != kind {
 		msg := fmt.Sprintf("expected next token to be %s, got %s instead", kind, p.tok.Kind)
@@ -88,6 +114,18 @@ func (p *parser) parseNode() Node {
 	if p.acceptKeyword("if") {
 		return p.parseIf()
 	}
+	if p.acceptKeyword("switch") {
+		return p.parseSwitch()
+	}
+	if p.acceptKeyword("while") {
+		return p.parseWhile()
+	}
+	if p.acceptKeyword("for") {
+		return p.parseFor()
+	}
+	if p.acceptKeyword("function") {
+		return p.parseFunction()
+	}
 	if p.accept(STRING) {
 		return p.parseCommand()
 	}
@@ -111,7 +149,6 @@ func (p *parser) parseIf() *IfNode {
 			p.next()
 			ifNode.Else = p.parseIfBlock()
 		} else if p.acceptKeyword("if") {
-			p.next()
 			ifNode.Else = p.parseIf()
 			expectEnd = false
 		} else {
@@ -126,13 +163,128 @@ func (p *parser) parseIf() *IfNode {
 }
 
 func (p *parser) parseIfBlock() *BlockNode {
+	return p.parseBlock("end", "else")
+}
+
+func (p *parser) parseSwitch() *SwitchNode {
+	p.next()
+	switchNode := &SwitchNode{}
+	switchNode.Value = p.parseWord()
+	p.expect(TERMINATOR)
+
+	for !p.acceptKeyword("end") {
+		if p.accept(EOF) {
+			p.error(p.tok.Pos, "unexpected EOF")
+			return switchNode
+		}
+		if !p.expectKeyword("case") {
+			continue
+		}
+		caseNode := &CaseNode{}
+		for p.accept(STRING) {
+			word := p.parseWord()
+			caseNode.Patterns = append(caseNode.Patterns, word)
+		}
+		p.expect(TERMINATOR)
+		caseNode.Body = p.parseBlock("case", "end")
+		switchNode.Cases = append(switchNode.Cases, caseNode)
+	}
+	p.expectKeyword("end")
+	p.expect(TERMINATOR)
+	return switchNode
+}
+
+func (p *parser) parseWhile() *WhileNode {
+	p.next()
+	whileNode := &WhileNode{}
+	whileNode.Cond = p.parseCommand()
+	whileNode.Body = p.parseLoopBody()
+	p.expectKeyword("end")
+	p.expect(TERMINATOR)
+	return whileNode
+}
+
+func (p *parser) parseFor() *ForNode {
+	p.next()
+	forNode := &ForNode{}
+	forNode.Var = p.parseWord()
+	p.expectKeyword("in")
+	for !p.accept(TERMINATOR) {
+		if p.accept(EOF) {
+			p.error(p.tok.Pos, "unexpected EOF")
+			break
+		}
+		word := p.parseWord()
+		forNode.List = append(forNode.List, word)
+	}
+	p.next()
+	forNode.Body = p.parseLoopBody()
+	p.expectKeyword("end")
+	p.expect(TERMINATOR)
+	return forNode
+}
+
+func (p *parser) parseFunction() *FunctionNode {
+	p.next()
+	fnNode := &FunctionNode{}
+	fnNode.Name = p.parseWord()
+	p.expect(TERMINATOR)
+
+	// loops outside of the function body cannot be broken from inside
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
+	fnNode.Body = p.parseBlock("end")
+	p.loopDepth = loopDepth
+
+	p.expectKeyword("end")
+	p.expect(TERMINATOR)
+	return fnNode
+}
+
+func (p *parser) parseLoopBody() *BlockNode {
+	p.loopDepth++
+	defer func() {
+		p.loopDepth--
+	}()
+	return p.parseBlock("end")
+}
+
+// parseLoopControl parses `break [N]` or `continue [N]`. N is clamped to the
+// number of enclosing loops.
+func (p *parser) parseLoopControl() (*Token, int) {
+	tok := p.tok
+	p.next()
+	if p.loopDepth == 0 {
+		p.error(tok.Pos, fmt.Sprintf("%s: only meaningful in a loop", tok.Literal))
+	}
+
+	count := 1
+	if p.accept(STRING) {
+		word := p.parseWord()
+		n, err := strconv.Atoi(word.Value)
+		if err != nil || n < 1 {
+			msg := fmt.Sprintf("%s: loop count must be a positive integer, got %q", tok.Literal, word.Value)
+			p.error(word.Token.Pos, msg)
+		} else {
+			count = n
+		}
+	}
+	if count > p.loopDepth && p.loopDepth > 0 {
+		count = p.loopDepth
+	}
+	return tok, count
+}
+
+// parseBlock parses statements until one of the given keywords appears.
+// The keyword itself is left for the caller to consume.
+func (p *parser) parseBlock(keywords ...string) *BlockNode {
 	block := &BlockNode{}
 	for {
 		if p.accept(EOF) {
 			p.error(p.tok.Pos, "unexpected EOF")
 			break
 		}
-		if p.acceptKeyword("end") || p.acceptKeyword("else") {
+		if p.acceptAnyKeyword(keywords...) {
 			break
 		}
 		stmt := p.parseNode()
@@ -141,24 +293,130 @@ func (p *parser) parseIfBlock() *BlockNode {
 	return block
 }
 
+// parseCommand parses pipelines joined by && or || followed by a
+// terminator. A pipeline of a single command is returned as the
+// *CommandNode itself.
 func (p *parser) parseCommand() Node {
+	node := p.parseAndOr()
+	if !p.accept(EOF) { // EOF is already reported by parseSimpleCommand
+		p.expect(TERMINATOR)
+	}
+	return node
+}
+
+// parseAndOr parses pipelines joined by && or ||. Both operators have the
+// same precedence and are left-associative.
+func (p *parser) parseAndOr() Node {
+	node := p.parsePipeline()
+	for p.accept(AND) || p.accept(OR) {
+		op := p.tok.Kind
+		p.next()
+		node = &AndOrNode{
+			Op:    op,
+			Left:  node,
+			Right: p.parsePipeline(),
+		}
+	}
+	return node
+}
+
+func (p *parser) parsePipeline() Node {
+	if p.acceptKeyword("!") {
+		p.next()
+		return &NotNode{
+			Body: p.parsePipeline(),
+		}
+	}
+	// break and continue can follow && or || but cannot be piped
+	if p.acceptKeyword("break") {
+		tok, count := p.parseLoopControl()
+		return &BreakNode{Token: tok, Count: count}
+	}
+	if p.acceptKeyword("continue") {
+		tok, count := p.parseLoopControl()
+		return &ContinueNode{Token: tok, Count: count}
+	}
+
+	cmd := p.parseSimpleCommand()
+	if !p.accept(PIPE) {
+		return cmd
+	}
+
+	pipeline := &PipelineNode{
+		List: []*CommandNode{cmd},
+	}
+	for p.accept(PIPE) {
+		p.next()
+		cmd := p.parseSimpleCommand()
+		pipeline.List = append(pipeline.List, cmd)
+	}
+	return pipeline
+}
+
+func (p *parser) parseSimpleCommand() *CommandNode {
 	cmd := &CommandNode{}
-	for !p.accept(TERMINATOR) {
+	for {
+		if p.accept(STRING) {
+			word := p.parseWord()
+			cmd.List = append(cmd.List, word)
+		} else if p.accept(GREAT) || p.accept(DGREAT) || p.accept(LESS) || p.accept(DLESS) || p.accept(DLESSDASH) {
+			redirect := p.parseRedirect()
+			cmd.Redirects = append(cmd.Redirects, redirect)
+		} else {
+			break
+		}
+	}
+	if len(cmd.List) == 0 {
 		if p.accept(EOF) {
 			p.error(p.tok.Pos, "unexpected EOF")
-			break
+		} else if len(cmd.Redirects) > 0 {
+			p.error(p.tok.Pos, "missing command before redirection")
+		} else {
+			msg := fmt.Sprintf("unexpected token %s", p.tok.Kind)
+			p.error(p.tok.Pos, msg)
 		}
-		word := p.parseWord()
-		cmd.List = append(cmd.List, word)
 	}
-	p.next()
 	return cmd
 }
 
+func (p *parser) parseRedirect() *RedirectNode {
+	op := p.tok.Kind
+	p.next()
+	redirect := &RedirectNode{
+		Op: op,
+	}
+	if (op == DLESS || op == DLESSDASH) && p.accept(STRING) {
+		// the scanner stops right after the delimiter, so the body is
+		// read when it reaches the end of the current line
+		redirect.Heredoc = p.scanner.AddHeredoc(p.tok.Literal, op == DLESSDASH)
+	}
+	redirect.Target = p.parseWord()
+	return redirect
+}
+
 func (p *parser) parseWord() *WordNode {
 	tok := p.expect(STRING)
-	return &WordNode{
+	word := &WordNode{
 		Token: tok,
 		Value: tok.Literal,
 	}
+	for _, src := range findSubsts(tok.Literal) {
+		word.Substs = append(word.Substs, p.parseSubst(tok, src))
+	}
+	return word
+}
+
+// parseSubst parses the body of a command substitution found in tok.
+// Errors are reported at the position of tok.
+func (p *parser) parseSubst(tok *Token, src string) *SubstNode {
+	sub := newParser(strings.NewReader(src))
+	prog := sub.parse()
+	if sub.errors != nil {
+		for _, err := range sub.errors.Errors {
+			p.error(tok.Pos, "in command substitution: "+err.Error())
+		}
+	}
+	return &SubstNode{
+		Prog: prog,
+	}
 }
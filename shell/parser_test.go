@@ -107,3 +107,325 @@ func TestParseIfNodeWithElse(t *testing.T) {
 	assert.Equal(t, "echo", elseNode.List[0].Value)
 	assert.Equal(t, "else", elseNode.List[1].Value)
 }
+
+func TestParseWhileNode(t *testing.T) {
+	input := `while test 1
+		echo loop
+	end
+	`
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*WhileNode)
+	if !ok {
+		t.Fatalf("expected *WhileNode, got=%T", prog.Body[0])
+	}
+	cond, ok := stmt.Cond.(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", stmt.Cond)
+	}
+	assert.Len(t, cond.List, 2)
+	assert.Equal(t, "test", cond.List[0].Value)
+
+	assert.Len(t, stmt.Body.List, 1)
+	body, ok := stmt.Body.List[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", stmt.Body.List[0])
+	}
+	assert.Equal(t, "echo", body.List[0].Value)
+	assert.Equal(t, "loop", body.List[1].Value)
+}
+
+func TestParseForNode(t *testing.T) {
+	input := `for u in alice bob; echo hi $u; end`
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*ForNode)
+	if !ok {
+		t.Fatalf("expected *ForNode, got=%T", prog.Body[0])
+	}
+	assert.Equal(t, "u", stmt.Var.Value)
+	assert.Len(t, stmt.List, 2)
+	assert.Equal(t, "alice", stmt.List[0].Value)
+	assert.Equal(t, "bob", stmt.List[1].Value)
+
+	assert.Len(t, stmt.Body.List, 1)
+	body, ok := stmt.Body.List[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", stmt.Body.List[0])
+	}
+	assert.Len(t, body.List, 3)
+	assert.Equal(t, "$u", body.List[2].Value)
+}
+
+func TestParseForNodeWithoutIn(t *testing.T) {
+	input := `for u alice bob; echo $u; end`
+	_, err := Parse(strings.NewReader(input))
+	assert.NotNil(t, err)
+}
+
+func TestParseLoopControl(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		count int
+		valid bool
+	}{
+		{"for x in a; break; end", 1, true},
+		{"for x in a; continue; end", 1, true},
+		{"for x in a; while echo; break 2; end; end", 2, true},
+		{"for x in a; break 5; end", 1, true},
+		{"for x in a; break 0; end", 1, false},
+		{"for x in a; break two; end", 1, false},
+		{"break", 1, false},
+		{"if echo; continue; end", 1, false},
+		{"for x in a; echo && break 2; end", 1, true},
+		{"for x in a; echo || continue; end", 1, true},
+		{"echo && break", 1, false},
+		{"for x in a; break | cat; end", 1, false},
+	} {
+		prog, err := Parse(strings.NewReader(tt.input))
+		if !tt.valid {
+			assert.NotNil(t, err, "input=%q", tt.input)
+			continue
+		}
+		assert.Nil(t, err, "input=%q got err=%s", tt.input, err)
+
+		var node Node = prog.Body[0]
+		for {
+			var body *BlockNode
+			switch loop := node.(type) {
+			case *ForNode:
+				body = loop.Body
+			case *WhileNode:
+				body = loop.Body
+			case *AndOrNode:
+				node = loop.Right
+				continue
+			}
+			if body == nil {
+				break
+			}
+			node = body.List[len(body.List)-1]
+		}
+		switch node := node.(type) {
+		case *BreakNode:
+			assert.Equal(t, tt.count, node.Count)
+		case *ContinueNode:
+			assert.Equal(t, tt.count, node.Count)
+		default:
+			t.Fatalf("expected *BreakNode or *ContinueNode, got=%T", node)
+		}
+	}
+}
+
+func TestParseFunctionNode(t *testing.T) {
+	input := `function greet
+		echo hello $1
+	end
+	`
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*FunctionNode)
+	if !ok {
+		t.Fatalf("expected *FunctionNode, got=%T", prog.Body[0])
+	}
+	assert.Equal(t, "greet", stmt.Name.Value)
+	assert.Len(t, stmt.Body.List, 1)
+	body, ok := stmt.Body.List[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", stmt.Body.List[0])
+	}
+	assert.Len(t, body.List, 3)
+	assert.Equal(t, "$1", body.List[2].Value)
+}
+
+func TestParseBreakInFunctionInLoop(t *testing.T) {
+	input := `for x in a; function f; break; end; end`
+	_, err := Parse(strings.NewReader(input))
+	assert.NotNil(t, err)
+}
+
+func TestParsePipelineNode(t *testing.T) {
+	input := "echo hello | cat | cat;"
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*PipelineNode)
+	if !ok {
+		t.Fatalf("expected *PipelineNode, got=%T", prog.Body[0])
+	}
+	assert.Len(t, stmt.List, 3)
+	assert.Len(t, stmt.List[0].List, 2)
+	assert.Equal(t, "echo", stmt.List[0].List[0].Value)
+	assert.Equal(t, "cat", stmt.List[1].List[0].Value)
+	assert.Equal(t, "cat", stmt.List[2].List[0].Value)
+}
+
+func TestParsePipelineError(t *testing.T) {
+	for _, input := range []string{
+		"echo |",
+		"| cat",
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, "input=%q", input)
+	}
+}
+
+func TestParseCommandSubstitution(t *testing.T) {
+	input := `echo "a $(echo b | cat) $(echo c)"`
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", prog.Body[0])
+	}
+	assert.Len(t, stmt.List, 2)
+	word := stmt.List[1]
+	assert.Len(t, word.Substs, 2)
+
+	pipeline, ok := word.Substs[0].Prog.Body[0].(*PipelineNode)
+	if !ok {
+		t.Fatalf("expected *PipelineNode, got=%T", word.Substs[0].Prog.Body[0])
+	}
+	assert.Len(t, pipeline.List, 2)
+	cmd, ok := word.Substs[1].Prog.Body[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", word.Substs[1].Prog.Body[0])
+	}
+	assert.Equal(t, "c", cmd.List[1].Value)
+
+	_, err = Parse(strings.NewReader(`echo $(echo |)`))
+	assert.NotNil(t, err)
+}
+
+func TestParseAndOrNode(t *testing.T) {
+	input := "echo a | cat && echo b || echo c;"
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	or, ok := prog.Body[0].(*AndOrNode)
+	if !ok {
+		t.Fatalf("expected *AndOrNode, got=%T", prog.Body[0])
+	}
+	assert.Equal(t, TokenKind(OR), or.Op)
+	right, ok := or.Right.(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", or.Right)
+	}
+	assert.Equal(t, "c", right.List[1].Value)
+
+	and, ok := or.Left.(*AndOrNode)
+	if !ok {
+		t.Fatalf("expected *AndOrNode, got=%T", or.Left)
+	}
+	assert.Equal(t, TokenKind(AND), and.Op)
+	if _, ok := and.Left.(*PipelineNode); !ok {
+		t.Fatalf("expected *PipelineNode, got=%T", and.Left)
+	}
+	if _, ok := and.Right.(*CommandNode); !ok {
+		t.Fatalf("expected *CommandNode, got=%T", and.Right)
+	}
+
+	_, err = Parse(strings.NewReader("echo a &&"))
+	assert.NotNil(t, err)
+}
+
+func TestParseNotNode(t *testing.T) {
+	input := "! echo a | cat && echo b;"
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	and, ok := prog.Body[0].(*AndOrNode)
+	if !ok {
+		t.Fatalf("expected *AndOrNode, got=%T", prog.Body[0])
+	}
+	not, ok := and.Left.(*NotNode)
+	if !ok {
+		t.Fatalf("expected *NotNode, got=%T", and.Left)
+	}
+	if _, ok := not.Body.(*PipelineNode); !ok {
+		t.Fatalf("expected *PipelineNode, got=%T", not.Body)
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	input := "cat < in>out >>log -;"
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*CommandNode)
+	if !ok {
+		t.Fatalf("expected *CommandNode, got=%T", prog.Body[0])
+	}
+	assert.Len(t, stmt.List, 2)
+	assert.Equal(t, "cat", stmt.List[0].Value)
+	assert.Equal(t, "-", stmt.List[1].Value)
+
+	assert.Len(t, stmt.Redirects, 3)
+	for i, expected := range []struct {
+		op     TokenKind
+		target string
+	}{
+		{LESS, "in"},
+		{GREAT, "out"},
+		{DGREAT, "log"},
+	} {
+		assert.Equal(t, expected.op, stmt.Redirects[i].Op)
+		assert.Equal(t, expected.target, stmt.Redirects[i].Target.Value)
+	}
+
+	for _, input := range []string{
+		"echo >",
+		"> out",
+		"echo > | cat",
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, "input=%q", input)
+	}
+}
+
+func TestParseSwitchNode(t *testing.T) {
+	input := `switch $cmd
+	case start 'run*'
+		echo starting
+	case '*'
+		echo unknown
+		echo again
+	end
+	`
+	prog, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err, "got err=%s", err)
+	assert.Len(t, prog.Body, 1)
+
+	stmt, ok := prog.Body[0].(*SwitchNode)
+	if !ok {
+		t.Fatalf("expected *SwitchNode, got=%T", prog.Body[0])
+	}
+	assert.Equal(t, "$cmd", stmt.Value.Value)
+	assert.Len(t, stmt.Cases, 2)
+	assert.Len(t, stmt.Cases[0].Patterns, 2)
+	assert.Equal(t, "start", stmt.Cases[0].Patterns[0].Value)
+	assert.Equal(t, "'run*'", stmt.Cases[0].Patterns[1].Value)
+	assert.Len(t, stmt.Cases[0].Body.List, 1)
+	assert.Len(t, stmt.Cases[1].Patterns, 1)
+	assert.Len(t, stmt.Cases[1].Body.List, 2)
+
+	for _, input := range []string{
+		"switch x; echo; end",
+		"switch x; case a; echo",
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, "input=%q", input)
+	}
+}
@@ -2,6 +2,7 @@ package shell
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"strings"
 	"unicode"
@@ -25,6 +26,13 @@ type Scanner struct {
 	insertTerminator bool
 	lastSize         int
 	pos              Position
+	heredocs         []*pendingHeredoc // here-documents to be read at the next line
+}
+
+type pendingHeredoc struct {
+	*Heredoc
+	delim string
+	strip bool // strip leading tabs
 }
 
 func NewScanner(r io.Reader, errHandler ErrorHandler) *Scanner {
@@ -69,6 +77,16 @@ func (s *Scanner) next() {
 	s.ch = ch
 }
 
+// peek returns the byte following the current character without advancing
+// the scanner.
+func (s *Scanner) peek() rune {
+	b, err := s.src.Peek(1)
+	if err != nil {
+		return EOF
+	}
+	return rune(b[0])
+}
+
 func (s *Scanner) Scan() *Token {
 scanAgain:
 	pos := s.pos
@@ -80,12 +98,27 @@ scanAgain:
 			s.insertTerminator = false
 			return newToken(TERMINATOR, "\n", pos)
 		}
+		newline := s.ch == '\n'
 		s.next()
+		if newline && len(s.heredocs) > 0 {
+			s.scanHeredocs()
+		}
 		pos = s.pos
 	}
 
+	if s.ch == '&' && s.peek() == '&' {
+		s.insertTerminator = false
+		s.next()
+		s.next()
+		return newToken(AND, "&&", pos)
+	}
+
 	switch s.ch {
 	case EOF:
+		for _, hd := range s.heredocs {
+			s.error(fmt.Sprintf("here-document delimited by end of file (wanted %q)", hd.delim))
+		}
+		s.heredocs = nil
 		if s.insertTerminator {
 			s.insertTerminator = false
 			return newToken(TERMINATOR, "", pos)
@@ -95,6 +128,34 @@ scanAgain:
 		s.insertTerminator = false
 		s.next()
 		return newToken(TERMINATOR, ";", pos)
+	case '|':
+		s.insertTerminator = false
+		s.next()
+		if s.ch == '|' {
+			s.next()
+			return newToken(OR, "||", pos)
+		}
+		return newToken(PIPE, "|", pos)
+	case '>':
+		s.insertTerminator = false
+		s.next()
+		if s.ch == '>' {
+			s.next()
+			return newToken(DGREAT, ">>", pos)
+		}
+		return newToken(GREAT, ">", pos)
+	case '<':
+		s.insertTerminator = false
+		s.next()
+		if s.ch == '<' {
+			s.next()
+			if s.ch == '-' {
+				s.next()
+				return newToken(DLESSDASH, "<<-", pos)
+			}
+			return newToken(DLESS, "<<", pos)
+		}
+		return newToken(LESS, "<", pos)
 	case '#':
 		s.skipComment()
 		goto scanAgain
@@ -119,6 +180,65 @@ scanAgain:
 	}
 }
 
+// AddHeredoc registers a here-document delimited by delim, whose body
+// starts at the line following the current one. The body of the returned
+// Heredoc is filled in when the scanner reaches there. If strip is true,
+// leading tabs are removed from each line of the body and the delimiter.
+func (s *Scanner) AddHeredoc(delim string, strip bool) *Heredoc {
+	hd := &pendingHeredoc{
+		Heredoc: &Heredoc{
+			Expand: true,
+		},
+		delim: delim,
+		strip: strip,
+	}
+	if unquoted := expandEscape(strings.Trim(delim, `'"`)); unquoted != delim {
+		hd.delim = unquoted
+		hd.Expand = false
+	}
+	s.heredocs = append(s.heredocs, hd)
+	return hd.Heredoc
+}
+
+// scanHeredocs reads the bodies of the pending here-documents from the
+// beginning of a line.
+func (s *Scanner) scanHeredocs() {
+	for _, hd := range s.heredocs {
+		hd.Pos = s.pos
+		var sb strings.Builder
+		for {
+			if s.ch == EOF {
+				s.error(fmt.Sprintf("here-document delimited by end of file (wanted %q)", hd.delim))
+				break
+			}
+			line := s.scanLine()
+			if hd.strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == hd.delim {
+				break
+			}
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+		hd.Body = sb.String()
+	}
+	s.heredocs = nil
+}
+
+// scanLine reads the rest of the current line and consumes its newline.
+func (s *Scanner) scanLine() string {
+	var sb strings.Builder
+	for s.ch != EOF && s.ch != '\n' {
+		sb.WriteRune(s.ch)
+		s.next()
+	}
+	if s.ch == '\n' {
+		s.next()
+	}
+	return sb.String()
+}
+
 func (s *Scanner) skipComment() {
 	for {
 		if s.ch == EOF || s.ch == '\r' || s.ch == '\n' {
@@ -134,8 +254,19 @@ func (s *Scanner) scanString(head string) string {
 scanEnd:
 	for {
 		switch s.ch {
-		case EOF, ';', '\'', '"':
+		case EOF, ';', '|', '<', '>', '\'', '"':
 			break scanEnd
+		case '&':
+			if s.peek() == '&' {
+				break scanEnd
+			}
+		case '$':
+			sb.WriteRune(s.ch)
+			s.next()
+			if s.ch == '(' || s.ch == '{' {
+				s.scanBracket(&sb)
+			}
+			continue
 		case '\\':
 			sb.WriteRune(s.ch)
 			s.next()
@@ -159,16 +290,22 @@ func (s *Scanner) scanQuotedString() string {
 
 	var sb strings.Builder
 	sb.WriteRune(quote)
+	s.next()
 	for {
-		s.next()
 		if s.ch == EOF {
 			s.error("unexpected end of string")
 			break
-		} else if s.ch == '\'' || s.ch == '"' {
-			if s.ch == quote {
-				sb.WriteRune(s.ch)
-				break
+		} else if s.ch == quote {
+			sb.WriteRune(s.ch)
+			s.next()
+			break
+		} else if s.ch == '$' && quote == '"' {
+			sb.WriteRune(s.ch)
+			s.next()
+			if s.ch == '(' || s.ch == '{' {
+				s.scanBracket(&sb)
 			}
+			continue
 		} else if s.ch == '\\' {
 			s.next()
 			if s.ch == EOF {
@@ -180,7 +317,50 @@ func (s *Scanner) scanQuotedString() string {
 			}
 		}
 		sb.WriteRune(s.ch)
+		s.next()
 	}
-	s.next()
 	return sb.String()
 }
+
+// scanBracket scans a text in parentheses or braces following `$`, such as
+// a command substitution. Nested brackets and quotes are balanced, so the
+// text may contain spaces, terminators and pipes.
+func (s *Scanner) scanBracket(sb *strings.Builder) {
+	open := s.ch
+	close := ')'
+	if open == '{' {
+		close = '}'
+	}
+
+	var quote rune
+	depth := 0
+	for {
+		if s.ch == EOF {
+			s.error(fmt.Sprintf("unbalanced %c", open))
+			return
+		}
+		ch := s.ch
+		sb.WriteRune(ch)
+		s.next()
+		switch {
+		case ch == '\\' && quote != '\'':
+			if s.ch != EOF {
+				sb.WriteRune(s.ch)
+				s.next()
+			}
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == open:
+			depth++
+		case ch == close:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
@@ -188,6 +188,81 @@ world`,
 				},
 			},
 		},
+		{
+			"echo hi|cat |\ncat",
+			[]*Token{
+				{
+					Kind:    STRING,
+					Literal: "echo",
+					Pos:     Position{Offset: 0, Line: 1, Column: 1},
+				},
+				{
+					Kind:    STRING,
+					Literal: "hi",
+					Pos:     Position{Offset: 5, Line: 1, Column: 6},
+				},
+				{
+					Kind:    PIPE,
+					Literal: "|",
+					Pos:     Position{Offset: 7, Line: 1, Column: 8},
+				},
+				{
+					Kind:    STRING,
+					Literal: "cat",
+					Pos:     Position{Offset: 8, Line: 1, Column: 9},
+				},
+				{
+					Kind:    PIPE,
+					Literal: "|",
+					Pos:     Position{Offset: 12, Line: 1, Column: 13},
+				},
+				{
+					Kind:    STRING,
+					Literal: "cat",
+					Pos:     Position{Offset: 14, Line: 2, Column: 1},
+				},
+				{
+					Kind:    TERMINATOR,
+					Literal: "",
+					Pos:     Position{Offset: 17, Line: 2, Column: 4},
+				},
+			},
+		},
+		{
+			"a&&b ||\nc",
+			[]*Token{
+				{
+					Kind:    STRING,
+					Literal: "a",
+					Pos:     Position{Offset: 0, Line: 1, Column: 1},
+				},
+				{
+					Kind:    AND,
+					Literal: "&&",
+					Pos:     Position{Offset: 1, Line: 1, Column: 2},
+				},
+				{
+					Kind:    STRING,
+					Literal: "b",
+					Pos:     Position{Offset: 3, Line: 1, Column: 4},
+				},
+				{
+					Kind:    OR,
+					Literal: "||",
+					Pos:     Position{Offset: 5, Line: 1, Column: 6},
+				},
+				{
+					Kind:    STRING,
+					Literal: "c",
+					Pos:     Position{Offset: 8, Line: 2, Column: 1},
+				},
+				{
+					Kind:    TERMINATOR,
+					Literal: "",
+					Pos:     Position{Offset: 9, Line: 2, Column: 2},
+				},
+			},
+		},
 	} {
 		r := strings.NewReader(tt.input)
 		scanner := NewScanner(r, nil)
@@ -211,6 +286,11 @@ func TestReadString(t *testing.T) {
 		{`hello\'`, `hello\'`},
 		{`hello\n`, `hello\n`},
 		{`hello\ world`, `hello\ world`},
+
+		// tests with command substitution
+		{`$(echo a; echo b) c`, `$(echo a; echo b)`},
+		{`a$(echo ")" | cat)b c`, `a$(echo ")" | cat)b`},
+		{`$(echo $(echo nested))`, `$(echo $(echo nested))`},
 	} {
 		r := strings.NewReader(tt.input)
 		scanner := NewScanner(r, nil)
@@ -265,3 +345,54 @@ func TestReadQuotedString(t *testing.T) {
 		assert.Equal(t, tt.err, err)
 	}
 }
+
+func TestScanHeredoc(t *testing.T) {
+	input := "cat <<-EOF; echo\n\thello\n\t  $x\n\tEOF\necho done"
+	scanner := NewScanner(strings.NewReader(input), nil)
+
+	for _, expected := range []*Token{
+		{Kind: STRING, Literal: "cat", Pos: Position{Offset: 0, Line: 1, Column: 1}},
+		{Kind: DLESSDASH, Literal: "<<-", Pos: Position{Offset: 4, Line: 1, Column: 5}},
+		{Kind: STRING, Literal: "EOF", Pos: Position{Offset: 7, Line: 1, Column: 8}},
+	} {
+		assert.Equal(t, expected, scanner.Scan())
+	}
+	hd := scanner.AddHeredoc("EOF", true)
+
+	for _, expected := range []*Token{
+		{Kind: TERMINATOR, Literal: ";", Pos: Position{Offset: 10, Line: 1, Column: 11}},
+		{Kind: STRING, Literal: "echo", Pos: Position{Offset: 12, Line: 1, Column: 13}},
+		{Kind: TERMINATOR, Literal: "\n", Pos: Position{Offset: 16, Line: 1, Column: 17}},
+		{Kind: STRING, Literal: "echo", Pos: Position{Offset: 35, Line: 5, Column: 1}},
+		{Kind: STRING, Literal: "done", Pos: Position{Offset: 40, Line: 5, Column: 6}},
+	} {
+		assert.Equal(t, expected, scanner.Scan())
+	}
+	assert.Equal(t, &Heredoc{
+		Pos:    Position{Offset: 17, Line: 2, Column: 1},
+		Body:   "hello\n  $x\n",
+		Expand: true,
+	}, hd)
+
+	scanner = NewScanner(strings.NewReader("cat <<'EOF'\n$x\nEOF"), nil)
+	for i := 0; i < 3; i++ {
+		scanner.Scan()
+	}
+	hd = scanner.AddHeredoc("'EOF'", false)
+	scanner.Scan()
+	assert.Equal(t, TokenKind(EOF), scanner.Scan().Kind)
+	assert.Equal(t, "$x\n", hd.Body)
+	assert.False(t, hd.Expand)
+
+	// a trailing backslash of the delimiter is literal
+	scanner = NewScanner(strings.NewReader("cat <<a\\"), nil)
+	for i := 0; i < 2; i++ {
+		scanner.Scan()
+	}
+	delim := scanner.Scan()
+	assert.Equal(t, `a\`, delim.Literal)
+	hd = scanner.AddHeredoc(delim.Literal, false)
+	assert.Equal(t, TokenKind(TERMINATOR), scanner.Scan().Kind)
+	assert.Equal(t, TokenKind(EOF), scanner.Scan().Kind)
+	assert.True(t, hd.Expand)
+}
@@ -2,37 +2,154 @@ package shell
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
+// errAborted stops expansions when the script is aborted.
+var errAborted = fmt.Errorf("aborted")
+
+// lastID is the last session ID assigned to a shell.
+var lastID int64
+
 type Command interface {
-	Run(shell *Shell, env *Environment, args []string) int
+	Run(ctx *ExecContext, args []string) int
 }
 
+// flow is a pending non-local transfer of control, such as break, which
+// unwinds the evaluation of blocks until it is consumed.
+type flow int
+
+const (
+	flowNone flow = iota
+	flowBreak
+	flowContinue
+	flowReturn
+	// flowAbort unwinds everything when the context of the script is done
+	// or the script exceeds a limit.
+	flowAbort
+)
+
+// StatusSyntax is the exit status of a script which cannot be parsed.
+const StatusSyntax = 2
+
+// Exit statuses of scripts which are aborted because their context is done.
+const (
+	StatusTimeout  = 124
+	StatusCanceled = 130
+)
+
 type Shell struct {
-	status   int
+	status      int
+	flow        flow
+	flowCount   int // number of loops left to unwind
+	abortStatus int // status of the script after flowAbort
+	commands    map[string]Command
+
+	// steps and depth are the resources used by the script, which are
+	// bounded by Limits.
+	steps int
+	depth int
+	// memory is the quota of Limits.Memory, which is shared with the
+	// scripts and FS.
+	memory *quota
+	// Limits bounds the resources which each script can use.
+	Limits Limits
+
+	// topLevel holds the global variables, which scripts share with each
+	// other. Universal is outside of it.
 	topLevel *Environment
-	commands map[string]Command
+
+	// FS holds the files of redirections. Init sets it to a MemFS if nil.
+	FS FileSystem
+
+	// Universal holds the universal variables, which may be shared with
+	// other shells. Init creates it if nil, loading it from Storage. It can
+	// be replaced between scripts along with Storage, such as to run the
+	// next script with the variables of another namespace.
+	Universal *Environment
+
+	// Storage keeps universal variables across restarts. They are saved
+	// after every script which changes them. They are kept only in memory
+	// if Storage is nil.
+	Storage Storage
+
+	// ID identifies the session of the shell. It is exposed to scripts
+	// as $$ and assigned automatically by Init if empty.
+	ID string
 
 	In  io.Reader
 	Out io.Writer
+	Err io.Writer
 }
 
-func (sh *Shell) Init() {
+func (sh *Shell) Init() error {
 	if sh.In == nil {
 		sh.In = bytes.NewReader(nil)
 	}
 	if sh.Out == nil {
 		sh.Out = ioutil.Discard
 	}
-	sh.topLevel = &Environment{}
+	if sh.Err == nil {
+		sh.Err = ioutil.Discard
+	}
+	if sh.Limits.Memory > 0 {
+		sh.memory = &quota{
+			limit: "memory",
+			max:   sh.Limits.Memory,
+		}
+	}
+	if sh.FS == nil {
+		fs := NewMemFS()
+		fs.quota = sh.memory
+		sh.FS = fs
+	}
+	if sh.ID == "" {
+		sh.ID = strconv.FormatInt(atomic.AddInt64(&lastID, 1), 10)
+	}
+	if sh.Universal == nil {
+		universal, err := LoadUniversal(sh.Storage)
+		if err != nil {
+			return err
+		}
+		sh.Universal = universal
+	}
+	sh.topLevel = &Environment{
+		outer: sh.Universal,
+	}
+	if sh.Limits.Storage > 0 {
+		sh.topLevel.LimitStorage(sh.Limits.Storage)
+	}
 	sh.commands = map[string]Command{}
 	for _, cmd := range builtins {
 		sh.AddCommand(cmd.name, cmd)
 	}
+	return nil
+}
+
+// LoadUniversal returns the universal variables in storage, or no variables
+// if storage is nil.
+func LoadUniversal(storage Storage) (*Environment, error) {
+	if storage == nil {
+		return &Environment{}, nil
+	}
+	universal, err := storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading universal variables: %s", err)
+	}
+	universal.takeModified()
+	return universal, nil
+}
+
+// Status returns the exit status of the last command, i.e. the value of $?.
+func (sh *Shell) Status() int {
+	return sh.status
 }
 
 func (sh *Shell) AddCommand(name string, cmd Command) {
@@ -44,82 +161,542 @@ func (sh *Shell) FindCommand(name string) Command {
 }
 
 func (sh *Shell) Exec(script string) {
+	sh.ExecWithContext(context.Background(), script)
+}
+
+// ExecWithContext is like Exec but aborts the script with the status
+// StatusTimeout or StatusCanceled when c is done.
+func (sh *Shell) ExecWithContext(c context.Context, script string) {
 	prog, err := Parse(strings.NewReader(script))
 	if err != nil {
-		fmt.Fprintln(sh.Out, "ghost:", err.Error())
+		fmt.Fprintln(sh.Err, "ghost:", err.Error())
+		sh.status = StatusSyntax
+		return
+	}
+	stdout, stderr := sh.Out, sh.Err
+	if sh.Limits.Output > 0 {
+		stdout = &limitedWriter{
+			sh: sh,
+			w:  sh.Out,
+			n:  sh.Limits.Output,
+		}
+		stderr = &limitedWriter{
+			sh: sh,
+			w:  sh.Err,
+			n:  sh.Limits.Output,
+		}
+	}
+	ctx := &ExecContext{
+		Context: c,
+		Shell:   sh,
+		Env:     sh.topLevel,
+		Stdin:   sh.In,
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+	// Universal may have been replaced since the last script
+	sh.topLevel.outer = sh.Universal
+	sh.flow = flowNone
+	sh.steps = 0
+	sh.depth = 0
+	sh.Eval(ctx, prog)
+	if sh.flow == flowAbort {
+		// commands may have overwritten the status while unwinding
+		sh.status = sh.abortStatus
+	}
+	sh.saveUniversal()
+}
+
+// aborted reports whether the evaluation has been aborted, aborting it if
+// the context is done.
+func (sh *Shell) aborted(ctx *ExecContext) bool {
+	if sh.flow == flowAbort {
+		return true
+	}
+	err := ctx.Err()
+	if err == nil {
+		return false
+	}
+	msg, status := abortReason(err)
+	sh.abort(msg, status)
+	return true
+}
+
+// abort reports msg to Err and unwinds the evaluation of the script, which
+// ends with status. Nothing is reported if the script has been aborted. msg
+// is written to Err directly to report it even if the standard error of the
+// script exceeds the output limit.
+func (sh *Shell) abort(msg string, status int) {
+	if sh.flow == flowAbort {
+		return
+	}
+	fmt.Fprintln(sh.Err, "ghost:", msg)
+	sh.flow = flowAbort
+	sh.status = status
+	sh.abortStatus = status
+}
+
+func abortReason(err error) (string, int) {
+	if err == context.DeadlineExceeded {
+		return "timeout", StatusTimeout
+	}
+	return "canceled", StatusCanceled
+}
+
+// saveUniversal saves the universal variables if they have been changed.
+// They are tried again after the next script if saving fails.
+func (sh *Shell) saveUniversal() {
+	if sh.Storage == nil || !sh.Universal.takeModified() {
 		return
 	}
-	env := &Environment{
-		outer: sh.topLevel,
+	if err := sh.Storage.Save(sh.Universal); err != nil {
+		sh.Universal.markModified()
+		fmt.Fprintln(sh.Err, "ghost: saving universal variables:", err)
 	}
-	sh.Eval(env, prog)
 }
 
-func (sh *Shell) error(env *Environment, msg string) {
-	fmt.Fprintln(sh.Out, "ghost:", msg)
+func (sh *Shell) error(ctx *ExecContext, msg string) {
+	if sh.flow == flowAbort {
+		// the error is caused by the abort, which has been reported
+		return
+	}
+	fmt.Fprintln(ctx.Stderr, "ghost:", msg)
 	sh.status = 127
 }
 
-func (sh *Shell) Eval(env *Environment, node Node) {
+func (sh *Shell) Eval(ctx *ExecContext, node Node) {
+	if sh.aborted(ctx) || !sh.step(ctx) {
+		return
+	}
+
 	switch node := node.(type) {
 	case *Program:
-		sh.evalProgram(env, node)
+		sh.evalProgram(ctx, node)
 
 	case *IfNode:
-		sh.evalIfNode(env, node)
+		sh.evalIfNode(ctx, node)
+
+	case *SwitchNode:
+		sh.evalSwitchNode(ctx, node)
+
+	case *WhileNode:
+		sh.evalWhileNode(ctx, node)
+
+	case *ForNode:
+		sh.evalForNode(ctx, node)
 
 	case *BlockNode:
-		sh.evalBlockNode(env, node)
+		sh.evalBlockNode(ctx, node)
+
+	case *NotNode:
+		sh.evalNotNode(ctx, node)
+
+	case *AndOrNode:
+		sh.evalAndOrNode(ctx, node)
+
+	case *PipelineNode:
+		sh.evalPipelineNode(ctx, node)
 
 	case *CommandNode:
-		sh.evalCommandNode(env, node)
+		sh.evalCommandNode(ctx, node)
+
+	case *FunctionNode:
+		sh.evalFunctionNode(ctx, node)
+
+	case *BreakNode:
+		sh.flow = flowBreak
+		sh.flowCount = node.Count
+		sh.status = 0
+
+	case *ContinueNode:
+		sh.flow = flowContinue
+		sh.flowCount = node.Count
+		sh.status = 0
 
 	case *BadNode:
-		sh.error(env, "bad statement")
+		sh.error(ctx, "bad statement")
 	}
 }
 
-func (sh *Shell) evalProgram(env *Environment, prog *Program) {
+func (sh *Shell) evalProgram(ctx *ExecContext, prog *Program) {
 	for _, stmt := range prog.Body {
-		sh.Eval(env, stmt)
+		sh.Eval(ctx, stmt)
+		if sh.flow != flowNone {
+			break
+		}
 	}
 }
 
-func (sh *Shell) evalIfNode(env *Environment, ifNode *IfNode) {
-	sh.Eval(env, ifNode.Cond)
+func (sh *Shell) evalIfNode(ctx *ExecContext, ifNode *IfNode) {
+	sh.Eval(ctx, ifNode.Cond)
+	if sh.flow != flowNone {
+		return
+	}
 	if sh.status == 0 {
-		sh.Eval(env, ifNode.Body)
+		sh.Eval(ctx, ifNode.Body)
 	} else if ifNode.Else != nil {
-		sh.Eval(env, ifNode.Else)
+		sh.Eval(ctx, ifNode.Else)
+	}
+}
+
+// evalSwitchNode evaluates the body of the first case which has a pattern
+// matching the value.
+func (sh *Shell) evalSwitchNode(ctx *ExecContext, switchNode *SwitchNode) {
+	value, err := sh.expandWordNode(ctx, switchNode.Value)
+	if err != nil {
+		sh.fail(ctx, err)
+		return
+	}
+
+	sh.status = 0
+	for _, caseNode := range switchNode.Cases {
+		for _, word := range caseNode.Patterns {
+			pattern, err := sh.expandPatternNode(ctx, word)
+			if err != nil {
+				sh.fail(ctx, err)
+				return
+			}
+			matched, err := compileGlob(pattern).match(ctx, []rune(value))
+			if err != nil {
+				sh.fail(ctx, err)
+				return
+			}
+			if matched {
+				sh.Eval(ctx, caseNode.Body)
+				return
+			}
+		}
+	}
+}
+
+func (sh *Shell) evalWhileNode(ctx *ExecContext, whileNode *WhileNode) {
+	status := 0
+	for {
+		sh.Eval(ctx, whileNode.Cond)
+		if sh.flow != flowNone {
+			// the status of return or an outer loop is kept
+			return
+		}
+		if sh.status != 0 {
+			break
+		}
+		sh.Eval(ctx, whileNode.Body)
+		status = sh.status
+		if sh.exitLoop() {
+			break
+		}
+	}
+	sh.status = status
+}
+
+func (sh *Shell) evalForNode(ctx *ExecContext, forNode *ForNode) {
+	items, size, err := sh.expandArgs(ctx, forNode.List)
+	defer sh.memory.add(-size)
+	if err != nil {
+		sh.fail(ctx, err)
+		return
+	}
+
+	sh.status = 0
+	for _, item := range items {
+		if err := ctx.Env.Set(forNode.Var.Value, item); err != nil {
+			sh.fail(ctx, err)
+			return
+		}
+		sh.Eval(ctx, forNode.Body)
+		if sh.exitLoop() {
+			break
+		}
 	}
 }
 
-func (sh *Shell) evalBlockNode(env *Environment, blockNode *BlockNode) {
+func (sh *Shell) evalFunctionNode(ctx *ExecContext, fnNode *FunctionNode) {
+	sh.AddCommand(fnNode.Name.Value, &function{
+		name: fnNode.Name.Value,
+		body: fnNode.Body,
+	})
+	sh.status = 0
+}
+
+// exitLoop consumes a pending break or continue on behalf of the innermost
+// loop and reports whether that loop must stop iterating.
+func (sh *Shell) exitLoop() bool {
+	switch sh.flow {
+	case flowBreak, flowContinue:
+		if sh.flowCount > 1 {
+			// unwind to an outer loop
+			sh.flowCount--
+			return true
+		}
+		f := sh.flow
+		sh.flow = flowNone
+		return f == flowBreak
+	}
+	return sh.flow != flowNone
+}
+
+func (sh *Shell) evalBlockNode(ctx *ExecContext, blockNode *BlockNode) {
 	for _, stmt := range blockNode.List {
-		sh.Eval(env, stmt)
+		sh.Eval(ctx, stmt)
+		if sh.flow != flowNone {
+			break
+		}
 	}
 }
 
-func (sh *Shell) evalCommandNode(env *Environment, cmdNode *CommandNode) {
-	args := []string{}
-	for _, arg := range cmdNode.List {
-		sh.expandWordNode(env, arg)
-		args = append(args, arg.Value)
+func (sh *Shell) evalNotNode(ctx *ExecContext, notNode *NotNode) {
+	sh.Eval(ctx, notNode.Body)
+	if sh.flow != flowNone {
+		return
+	}
+	if sh.status == 0 {
+		sh.status = 1
+	} else {
+		sh.status = 0
+	}
+}
+
+func (sh *Shell) evalAndOrNode(ctx *ExecContext, andOrNode *AndOrNode) {
+	sh.Eval(ctx, andOrNode.Left)
+	if sh.flow != flowNone {
+		return
+	}
+	if (andOrNode.Op == AND) == (sh.status == 0) {
+		sh.Eval(ctx, andOrNode.Right)
+	}
+}
+
+// evalPipelineNode runs the commands one after another, feeding the output
+// of each command to the input of the next one.
+func (sh *Shell) evalPipelineNode(ctx *ExecContext, pipeNode *PipelineNode) {
+	stdin := ctx.Stdin
+	var prev *buffer
+	last := len(pipeNode.List) - 1
+	for i, cmdNode := range pipeNode.List {
+		if i == last {
+			sh.Eval(ctx.WithIO(stdin, ctx.Stdout), cmdNode)
+			break
+		}
+		buf := &buffer{sh: sh}
+		sh.Eval(ctx.WithIO(stdin, buf), cmdNode)
+		// the output of the previous command has been consumed
+		prev.release()
+		prev, stdin = buf, buf
+	}
+	prev.release()
+}
+
+func (sh *Shell) evalCommandNode(ctx *ExecContext, cmdNode *CommandNode) {
+	args, size, err := sh.expandArgs(ctx, cmdNode.List)
+	defer sh.memory.add(-size)
+	if err != nil {
+		sh.fail(ctx, err)
+		return
+	}
+
+	for _, redirectNode := range cmdNode.Redirects {
+		redirected, f, err := sh.redirect(ctx, redirectNode)
+		if err != nil {
+			sh.fail(ctx, err)
+			return
+		}
+		defer f.Close()
+		ctx = redirected
 	}
 
+	if len(args) == 0 {
+		// every word was an empty list
+		sh.status = 0
+		return
+	}
 	command := sh.FindCommand(args[0])
 	if command == nil {
-		sh.error(env, fmt.Sprintf("unknown command %q", args[0]))
+		sh.error(ctx, fmt.Sprintf("unknown command %q", args[0]))
 		return
 	}
-	sh.status = command.Run(sh, env, args)
+	sh.status = command.Run(ctx, args)
+	// the command may have been stopped by the context in the middle
+	sh.aborted(ctx)
 }
 
-func (sh *Shell) expandWordNode(env *Environment, word *WordNode) {
-	s, err := expand(env, word.Value)
+// redirect opens the target of redirectNode and returns a copy of ctx which
+// uses it as the standard input or output.
+func (sh *Shell) redirect(ctx *ExecContext, redirectNode *RedirectNode) (*ExecContext, io.Closer, error) {
+	if hd := redirectNode.Heredoc; hd != nil {
+		body, err := sh.expandHeredoc(ctx, hd)
+		if err != nil {
+			return nil, nil, err
+		}
+		r := ioutil.NopCloser(strings.NewReader(body))
+		return ctx.WithIO(r, ctx.Stdout), r, nil
+	}
+
+	name, err := sh.expandWordNode(ctx, redirectNode.Target)
 	if err != nil {
-		sh.error(env, err.Error())
-		return
+		return nil, nil, err
+	}
+	if name == "" {
+		return nil, nil, fmt.Errorf("redirection to an empty file name")
+	}
+
+	switch redirectNode.Op {
+	case LESS:
+		r, err := sh.FS.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ctx.WithIO(r, ctx.Stdout), r, nil
+	case DGREAT:
+		w, err := sh.FS.Append(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ctx.WithIO(ctx.Stdin, &abortWriter{sh: sh, w: w}), w, nil
+	default:
+		w, err := sh.FS.Create(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ctx.WithIO(ctx.Stdin, &abortWriter{sh: sh, w: w}), w, nil
+	}
+}
+
+// expandHeredoc returns the body of hd with parameters, command
+// substitutions and arithmetic expanded unless its delimiter is quoted.
+// A backslash escapes only `$` and another backslash, and is kept as it is
+// before the other characters.
+func (sh *Shell) expandHeredoc(ctx *ExecContext, hd *Heredoc) (string, error) {
+	if !hd.Expand {
+		return hd.Body, nil
+	}
+
+	var substs []*SubstNode
+	for _, src := range scanSubsts(hd.Body) {
+		prog, err := Parse(strings.NewReader(src))
+		if err != nil {
+			return "", fmt.Errorf("%d:%d in command substitution: %s", hd.Pos.Line, hd.Pos.Column, err)
+		}
+		substs = append(substs, &SubstNode{Prog: prog})
+	}
+	x := sh.newExpander(ctx, substs)
+	x.heredoc = true
+	return x.expandDollar(hd.Body)
+}
+
+// expandWordNode returns the expanded value of word. The node itself is
+// left untouched so that it can be evaluated again, e.g. in a loop body.
+func (sh *Shell) expandWordNode(ctx *ExecContext, word *WordNode) (string, error) {
+	x := sh.newExpander(ctx, word.Substs)
+	return x.expand(word.Value)
+}
+
+// expandPatternNode is like expandWordNode but returns a pattern for
+// matchGlob, in which the quoted parts of word are literal.
+func (sh *Shell) expandPatternNode(ctx *ExecContext, word *WordNode) (string, error) {
+	x := sh.newExpander(ctx, word.Substs)
+	return x.expandPattern(word.Value)
+}
+
+// expandWordFields is like expandWordNode but splits the word into fields at
+// the elements of lists unless it is quoted.
+func (sh *Shell) expandWordFields(ctx *ExecContext, word *WordNode) ([]string, error) {
+	x := sh.newExpander(ctx, word.Substs)
+	return x.expandFields(word.Value)
+}
+
+// expandArgs expands words into fields like expandWordFields. The fields
+// are counted against the memory limit, and the caller must give back the
+// returned size when they are no longer used even if an error is returned.
+func (sh *Shell) expandArgs(ctx *ExecContext, words []*WordNode) ([]string, int, error) {
+	args := []string{}
+	size := 0
+	for _, word := range words {
+		fields, err := sh.expandWordFields(ctx, word)
+		if err != nil {
+			return nil, size, err
+		}
+		n := 0
+		for _, field := range fields {
+			n += len(field)
+		}
+		if err := sh.memory.add(n); err != nil {
+			return nil, size, err
+		}
+		size += n
+		args = append(args, fields...)
+	}
+	return args, size, nil
+}
+
+func (sh *Shell) newExpander(ctx *ExecContext, substs []*SubstNode) *expander {
+	return &expander{
+		ctx:   ctx,
+		env:   ctx.Env,
+		quota: sh.memory,
+		param: func(name string) (string, bool) {
+			return sh.specialParam(ctx, name)
+		},
+		list: func(name string) ([]string, bool) {
+			if name == "@" || name == "*" {
+				return ctx.Args, true
+			}
+			return nil, false
+		},
+		substs: substs,
+		subst: func(prog *Program) (string, error) {
+			out := sh.substitute(ctx, prog)
+			if sh.flow == flowAbort {
+				return "", errAborted
+			}
+			return out, nil
+		},
+	}
+}
+
+// specialParam returns the value of a parameter maintained by the shell
+// itself rather than by an environment.
+func (sh *Shell) specialParam(ctx *ExecContext, name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(sh.status), true
+	case "$":
+		return sh.ID, true
+	case "#":
+		return strconv.Itoa(len(ctx.Args)), true
+	case "@", "*":
+		return strings.Join(ctx.Args, " "), true
+	case "RANDOM":
+		return strconv.Itoa(rand.Intn(32768)), true
+	}
+	if isDigit(name[0]) {
+		// leading zeros are allowed, so that ${00} is $0
+		n, err := strconv.Atoi(name)
+		switch {
+		case err != nil || n > len(ctx.Args):
+			return "", false
+		case n == 0:
+			return "ghost", true
+		}
+		return ctx.Args[n-1], true
+	}
+	return "", false
+}
+
+// substitute evaluates prog in a child environment, like a subshell, and
+// returns its output.
+func (sh *Shell) substitute(ctx *ExecContext, prog *Program) string {
+	if !sh.enter(ctx) {
+		return ""
+	}
+	defer sh.leave()
+
+	buf := &buffer{sh: sh}
+	defer buf.release()
+	env := ctx.Env.child()
+	defer env.release()
+	sh.Eval(ctx.WithEnv(env).WithIO(ctx.Stdin, buf), prog)
+	if sh.flow != flowAbort {
+		sh.flow = flowNone
 	}
-	word.Value = s
+	return buf.String()
 }
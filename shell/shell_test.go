@@ -2,7 +2,16 @@ package shell
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,6 +29,298 @@ func TestShellExec(t *testing.T) {
 			`set x hello; echo $x`,
 			"hello\n",
 		},
+		{
+			`for u in alice bob; echo hi $u; end`,
+			"hi alice\nhi bob\n",
+		},
+		{
+			`for i in 1 2; for j in a b; echo $i$j; end; end`,
+			"1a\n1b\n2a\n2b\n",
+		},
+		{
+			`while unknown; echo never; end`,
+			"",
+		},
+		{
+			`while echo loop; break; end; echo done`,
+			"loop\ndone\n",
+		},
+		{
+			`for i in 1 2 3; if echo $i; continue; end; echo never; end`,
+			"1\n2\n3\n",
+		},
+		{
+			`for i in 1 2; for j in a b; echo $i$j; break 2; end; end; echo done`,
+			"1a\ndone\n",
+		},
+		{
+			`for i in 1 2 3; test $i = 2 && break; echo $i; end; for i in 1 2 3; test $i = 2 || continue; echo $i; end`,
+			"1\n2\n",
+		},
+		{
+			`for i in 1 2; for j in a b; echo $i$j; continue 2; end; end`,
+			"1a\n2a\n",
+		},
+		{
+			`function greet; echo hello $1; end; greet bob`,
+			"hello bob\n",
+		},
+		{
+			`function count; echo $# $@; end; count a b c`,
+			"3 a b c\n",
+		},
+		{
+			`function f; return 1; echo never; end; if f; echo yes; else; echo no; end`,
+			"no\n",
+		},
+		{
+			`function f; for i in 1 2 3; echo $i; return; end; end; f; echo after`,
+			"1\nafter\n",
+		},
+		{
+			`function f; set x inner; echo $x; end; set x outer; f; echo $x`,
+			"inner\nouter\n",
+		},
+		{
+			`echo hello | cat`,
+			"hello\n",
+		},
+		{
+			`echo hello | cat | cat; echo world`,
+			"hello\nworld\n",
+		},
+		{
+			`function upper; cat; echo done; end; echo piped | upper`,
+			"piped\ndone\n",
+		},
+		{
+			`echo discarded | echo last`,
+			"last\n",
+		},
+		{
+			`set n $(echo 3); echo $n`,
+			"3\n",
+		},
+		{
+			`echo "count: $(echo a b | cat)"`,
+			"count: a b\n",
+		},
+		{
+			`echo $(echo $(echo deep))`,
+			"deep\n",
+		},
+		{
+			`echo \$(echo hi) "\$(echo hi)" "\\$(echo hi)" \$x`,
+			"$(echo hi) $(echo hi) \\hi $x\n",
+		},
+		{
+			`echo $(set x leaked)[${x}]`,
+			"[]\n",
+		},
+		{
+			`function greet; echo hello $1; end; echo "<$(greet bob)>"`,
+			"<hello bob>\n",
+		},
+		{
+			`set i 2; echo $((i * (i + 1))) $(( $i + 1 ))`,
+			"6 3\n",
+		},
+		{
+			`echo "sum: $((1 + 2))"`,
+			"sum: 3\n",
+		},
+		{
+			`set i 0; while let "i < 3"; echo $i; let i=i+1; end`,
+			"0\n1\n2\n",
+		},
+		{
+			`math "(1 + 2) * 3"`,
+			"9\n",
+		},
+		{
+			`if test 1; echo yes; end`,
+			"yes\n",
+		},
+		{
+			`set x 3; if [ $x -gt 5 ]; echo big; else if [ $x -gt 1 ]; echo medium; else; echo small; end`,
+			"medium\n",
+		},
+		{
+			`set i 0; while [ $i -lt 3 ]; echo $i; let i=i+1; end`,
+			"0\n1\n2\n",
+		},
+		{
+			`test 1 = 2 && echo ok || echo fail`,
+			"fail\n",
+		},
+		{
+			`test 1 = 1 && echo ok || echo fail`,
+			"ok\n",
+		},
+		{
+			`test 1 = 2 || test 2 = 2 && echo yes`,
+			"yes\n",
+		},
+		{
+			`echo a | cat && echo b&&echo c`,
+			"a\nb\nc\n",
+		},
+		{
+			`echo a&b`,
+			"a&b\n",
+		},
+		{
+			`function f; if return 3; echo never; end; end; f; echo $?; function g; while return 4; echo never; end; end; g; echo $?`,
+			"3\n4\n",
+		},
+		{
+			`function f; test $1 = x || return 1; echo is x; end; f x; f y && echo never`,
+			"is x\n",
+		},
+		{
+			`if ! test a = b; echo negated; end`,
+			"negated\n",
+		},
+		{
+			`! test a = a || echo fail`,
+			"fail\n",
+		},
+		{
+			`test 1 = 2; echo $?; ! echo a | cat; echo $?`,
+			"1\na\n1\n",
+		},
+		{
+			`unknown; echo $?; echo $?`,
+			"127\n0\n",
+		},
+		{
+			`echo $0 $#; set x 1; echo [$x] 5$ $%`,
+			"ghost 0\n[1] 5$ $%\n",
+		},
+		{
+			`function f; echo $# "$@" $*/$2/$3; end; f a b`,
+			"2 a b a b/b/\n",
+		},
+		{
+			`function f; echo $(( $1 + 1 )) $(( $# )) $(( $(echo 2) * $2 )) $(( $xs[$#] )); end; set -a xs 5 6; f 2 4`,
+			"3 2 8 6\n",
+		},
+		{
+			`function f; echo ${00} ${000} ${01} [${99999999999999999999}]; end; f a; echo ${00}`,
+			"ghost ghost a []\nghost\n",
+		},
+		{
+			`function inner; echo [$1$2]; end; function outer; inner $2; end; outer a b`,
+			"[b]\n",
+		},
+		{
+			`echo hi > notes; echo there >> notes; cat < notes`,
+			"hi\nthere\n",
+		},
+		{
+			`set f notes; echo one > $f; echo two > $f; echo a | cat - $f`,
+			"a\ntwo\n",
+		},
+		{
+			`function f; echo $1 >> log; end; f a; f b; cat log | cat`,
+			"a\nb\n",
+		},
+		{
+			"set x world\ncat <<EOF\nhello $x\n  'quoted' \\$x \\\\$x \\d\nEOF\necho done",
+			"hello world\n  'quoted' $x \\world \\d\ndone\n",
+		},
+		{
+			"cat <<'EOF'\nhello $x\nEOF",
+			"hello $x\n",
+		},
+		{
+			"if test 1\n\tcat <<-END\n\t\tindented\n\tEND\nend",
+			"indented\n",
+		},
+		{
+			"cat <<A; cat <<B | cat\na\nA\nb\nB\necho $(cat <<C\nsub\nC\n)",
+			"a\nb\nsub\n",
+		},
+		{
+			"cat <<EOF\n'$(echo sub)' $((1 + 1))\nEOF",
+			"'sub' 2\n",
+		},
+		{
+			`function cmd; switch $1; case start run*; echo starting; case st[a-z]p; echo stopping; case '*' "?"; echo literal $1; case *; echo unknown $1; end; end; cmd start; cmd running; cmd stop; cmd '*'; cmd '?'; cmd x`,
+			"starting\nstarting\nstopping\nliteral *\nliteral ?\nunknown x\n",
+		},
+		{
+			`set p 'a*'; for v in abc 'a*' '[x]' x; switch $v; case "$p" \[x\]; echo literal $v; case $p; echo glob $v; case *; echo none $v; end; end`,
+			"glob abc\nliteral a*\nliteral [x]\nnone x\n",
+		},
+		{
+			`for x in a b c; switch $x; case b; continue; end; echo $x; end`,
+			"a\nc\n",
+		},
+		{
+			`switch none; case a; echo a; end; echo $?`,
+			"0\n",
+		},
+		{
+			`set x X; echo ${x:-$(echo a)} $(echo b) ${unset:-$(echo c) d}`,
+			"X b c d\n",
+		},
+		{
+			`function greet; echo hello ${1:-world} ${2+second}; end; greet; greet bob ""`,
+			"hello world \nhello bob second\n",
+		},
+		{
+			`echo ${n:=3}; echo $n`,
+			"3\n3\n",
+		},
+		{
+			`set -a xs a "b c" d; echo $xs[1] $xs[-1] ${#xs} $#xs; for x in $xs; echo "[$x]"; end`,
+			"a d 3 0xs\n[a]\n[b c]\n[d]\n",
+		},
+		{
+			`set -a xs a "b c"; for x in "$xs" pre${xs}post; echo "[$x]"; end`,
+			"[a b c]\n[prea]\n[b cpost]\n",
+		},
+		{
+			`set -a empty; for x in $empty; echo never; end; $empty; echo $? [$empty] "$empty" ${#empty}`,
+			"0 []  0\n",
+		},
+		{
+			`function count; echo $#; end; set -a xs 1 2 3; count $xs; count "$xs"; count $xs $xs`,
+			"3\n1\n6\n",
+		},
+		{
+			`function args; for a in $@; echo "<$a>"; end; count "$@"; end; function count; echo $#; end; args x "y z"`,
+			"<x>\n<y z>\n1\n",
+		},
+		{
+			`set -a xs a b; set xs c; echo $xs ${#xs}; set -a xs; echo ${#xs}`,
+			"c 1\n0\n",
+		},
+		{
+			`function f; set -g g global; set -l l local; set x inner; echo $g $l $x; end; set x outer; f; echo $g [$l] $x`,
+			"global local inner\nglobal [] outer\n",
+		},
+		{
+			`set -U u universal; set u global; echo $u; unset u; echo $u; unset u; echo [$u] $?`,
+			"global\nuniversal\n[] 0\n",
+		},
+		{
+			`set x global; function f; set x local; unset -g x; echo $x; unset x; echo [$x]; end; f; echo [$x]`,
+			"local\n[]\n[]\n",
+		},
+		{
+			`set -U u 1; set -g b 2; set -a a x y; function f; set -l b 3; set; echo; set -l; echo; set -U; end; f`,
+			"a x y\nb 3\nu 1\n\nb 3\n\nu 1\n",
+		},
+		{
+			`set -g -r prefix %; set x 1; readonly x; readonly; function f; set y 2; readonly y=3 prefix; readonly; end; f`,
+			"prefix %\nx 1\nprefix %\nx 1\ny 3\n",
+		},
+		{
+			`set -a xs a b c; set i 2; echo $xs[i] $xs[$i+1] [$xs[4]] ${xs[1]:-x} ${xs[9]:-x}`,
+			"b c [] a x\n",
+		},
 	} {
 		buf := bytes.NewBuffer(nil)
 		sh := &Shell{
@@ -31,3 +332,337 @@ func TestShellExec(t *testing.T) {
 		assert.Equal(t, tt.expected, buf.String())
 	}
 }
+
+func TestShellGlobalVariables(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sh := &Shell{
+		Out: buf,
+	}
+	sh.Init()
+
+	sh.Exec(`set x 1; set -a xs a b; set -U u 2; function f; set y 3; end; f; for i in 4; end`)
+	sh.Exec(`echo $x $xs[2] $u [$y] $i; echo $(set s subshell)[$s]`)
+	assert.Equal(t, "1 b 2 [] 4\n[]\n", buf.String())
+}
+
+func TestShellStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(filepath.Join(dir, "universal.json"))
+
+	sh := &Shell{
+		Storage: storage,
+	}
+	assert.Nil(t, sh.Init())
+	sh.Exec(`set -U greeting hello; set -U -a admins alice bob; set -g lost 1`)
+
+	buf := bytes.NewBuffer(nil)
+	restarted := &Shell{
+		Out:     buf,
+		Storage: storage,
+	}
+	assert.Nil(t, restarted.Init())
+	restarted.Exec(`echo $greeting $admins[2] [$lost]; unset -U greeting`)
+
+	env, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admins"}, env.Names())
+	assert.Equal(t, "hello bob []\n", buf.String())
+
+	errBuf := bytes.NewBuffer(nil)
+	broken := &Shell{
+		Err:     errBuf,
+		Storage: NewFileStorage(filepath.Join(dir, "missing", "universal.json")),
+	}
+	assert.Nil(t, broken.Init())
+	broken.Exec(`set -U x 1; set -g y 2`)
+	assert.Contains(t, errBuf.String(), "ghost: saving universal variables:")
+}
+
+func TestShellSpecialParams(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sh := &Shell{
+		ID:  "session",
+		Out: buf,
+	}
+	sh.Init()
+
+	sh.Exec(`echo $$; set RANDOM 1; echo $RANDOM`)
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "session", lines[0])
+	n, err := strconv.Atoi(lines[1])
+	assert.Nil(t, err)
+	assert.True(t, 0 <= n && n < 32768, "got $RANDOM=%d", n)
+
+	other := &Shell{}
+	other.Init()
+	assert.NotEmpty(t, other.ID)
+	assert.NotEqual(t, sh.ID, other.ID)
+}
+
+func TestShellExecError(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		stdout string
+		stderr string
+	}{
+		{
+			`echo before; unknown; echo after`,
+			"before\nafter\n",
+			"ghost: unknown command \"unknown\"\n",
+		},
+		{
+			`echo hello | set x`,
+			"",
+			setUsage + "\n",
+		},
+		{
+			`set -g -U x 1; set -x y 1; unset -q y; unset`,
+			"",
+			"set: conflicting scopes\n" + setUsage + "\n" +
+				"set: unknown option -x\n" + setUsage + "\n" +
+				"unset: unknown option -q\nusage: unset [-l|-g|-U] VARIABLE_NAME...\n" +
+				"usage: unset [-l|-g|-U] VARIABLE_NAME...\n",
+		},
+		{
+			`echo $((1 / 0)); echo next`,
+			"next\n",
+			"ghost: division by zero\n",
+		},
+		{
+			`[ a = a; test 1 -lt b`,
+			"",
+			"[: missing ]\ntest: integer expression expected: \"b\"\n",
+		},
+		{
+			`cat < missing; cat missing; echo > ""`,
+			"",
+			"ghost: missing: no such file\ncat: missing: no such file\nghost: redirection to an empty file name\n",
+		},
+		{
+			"cat <<EOF\nhello",
+			"",
+			"ghost: 2:6 here-document delimited by end of file (wanted \"EOF\")\n",
+		},
+		{
+			`cat <<a\`,
+			"",
+			"ghost: 1:9 unexpected end of string; 1:9 here-document delimited by end of file (wanted \"a\\\\\")\n",
+		},
+		{
+			`set -a xs a; echo ${xs[2]:?is required}; echo ${xs[3]:=x}`,
+			"",
+			"ghost: xs[2]: is required\nghost: $xs[3]: cannot assign in this way\n",
+		},
+		{
+			`readonly greeting=hi; set greeting bye; echo $greeting $?; function f; set greeting local; end; f; echo $?`,
+			"hi 1\n1\n",
+			"ghost: greeting: readonly variable\nghost: greeting: readonly variable\n",
+		},
+		{
+			`set -r -a xs a; unset xs; let xs=1; for xs in b; echo never; end; echo ${xs:=c} $xs`,
+			"a a\n",
+			"ghost: xs: readonly variable\nghost: xs: readonly variable\nghost: xs: readonly variable\n",
+		},
+		{
+			`set -U -r owner me; echo $? [$owner]; set -U owner me; readonly owner; set -U owner you; echo $owner`,
+			"1 []\nyou\n",
+			"ghost: owner: universal variables cannot be made readonly\nghost: owner: universal variables cannot be made readonly\n",
+		},
+		{
+			`readonly missing; set -r y; echo $?; readonly e=; echo ${e:=x}`,
+			"1\n",
+			"ghost: missing: not set\n" + setUsage + "\nghost: e: readonly variable\n",
+		},
+		{
+			`echo ${name:?is required}; echo ${1:=x}`,
+			"",
+			"ghost: name: is required\nghost: $1: cannot assign in this way\n",
+		},
+		{
+			`math 9223372036854775807 + 1`,
+			"",
+			"math: integer overflow\n",
+		},
+		{
+			`echo 'unterminated`,
+			"",
+			"ghost: 1:19 unexpected end of string\n",
+		},
+		{
+			`return 2; echo $?; echo $(return)`,
+			"1\n\n",
+			"return: not in a function\nreturn: not in a function\n",
+		},
+		{
+			`break; continue`,
+			"",
+			"ghost: 1:1 break: only meaningful in a loop; 1:8 continue: only meaningful in a loop\n",
+		},
+	} {
+		stdout := bytes.NewBuffer(nil)
+		stderr := bytes.NewBuffer(nil)
+		sh := &Shell{
+			Out: stdout,
+			Err: stderr,
+		}
+		sh.Init()
+
+		sh.Exec(tt.script)
+		assert.Equal(t, tt.stdout, stdout.String())
+		assert.Equal(t, tt.stderr, stderr.String())
+	}
+}
+
+func TestShellSyntaxError(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sh := &Shell{
+		Out: buf,
+	}
+	sh.Init()
+
+	sh.Exec(`echo 'unterminated`)
+	assert.Equal(t, StatusSyntax, sh.Status())
+	sh.Exec(`echo $?`)
+	assert.Equal(t, "2\n", buf.String())
+}
+
+func TestShellAddCommand(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sh := &Shell{
+		Out: buf,
+	}
+	sh.Init()
+	sh.AddCommand("upper", CommandFunc(func(ctx *ExecContext, args []string) int {
+		b, err := ioutil.ReadAll(ctx.Stdin)
+		if err != nil {
+			return 1
+		}
+		ctx.Stdout.Write(bytes.ToUpper(b))
+		return 0
+	}))
+
+	sh.Exec(`echo hello | upper; echo world`)
+	assert.Equal(t, "HELLO\nworld\n", buf.String())
+}
+
+func TestShellSharedUniversal(t *testing.T) {
+	universal := &Environment{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		buf := bytes.NewBuffer(nil)
+		sh := &Shell{
+			Out:       buf,
+			Universal: universal,
+		}
+		sh.Init()
+		name := "v" + strconv.Itoa(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				sh.Exec(`set -U ` + name + ` ` + strconv.Itoa(j) + `; set -U -a shared $shared; set; unset -U nothing`)
+			}
+			buf.Reset()
+			sh.Exec(`echo $` + name)
+			assert.Equal(t, "49\n", buf.String())
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, universal.Names(), 9)
+}
+
+func TestShellReplaceUniversal(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sh := &Shell{
+		Out: buf,
+	}
+	sh.Init()
+	first := sh.Universal
+	sh.Exec(`set -U u first; set g global`)
+
+	sh.Universal = &Environment{}
+	sh.Exec(`echo [$u] $g; set -U u second`)
+	assert.Equal(t, "[] global\n", buf.String())
+	val, _ := first.Get("u")
+	assert.Equal(t, "first", val)
+	val, _ = sh.Universal.Get("u")
+	assert.Equal(t, "second", val)
+}
+
+func TestShellExecTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		stdout string
+	}{
+		{`echo before; while test 1; set x 1; end; echo never`, "before\n"},
+		{`function f; f2; end; function f2; while test 1; end; end; ! f || echo never; echo never`, ""},
+		{`for i in 1 2; echo $(while test 1; end) never; end`, ""},
+		{`set -a xs; while test 1; set -a xs $xs x; end`, ""},
+	} {
+		stdout := bytes.NewBuffer(nil)
+		stderr := bytes.NewBuffer(nil)
+		sh := &Shell{
+			Out: stdout,
+			Err: stderr,
+		}
+		sh.Init()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		sh.ExecWithContext(ctx, tt.script)
+		cancel()
+		assert.Equal(t, tt.stdout, stdout.String(), "script=%q", tt.script)
+		assert.Equal(t, "ghost: timeout\n", stderr.String(), "script=%q", tt.script)
+		assert.Equal(t, StatusTimeout, sh.Status(), "script=%q", tt.script)
+
+		stdout.Reset()
+		stderr.Reset()
+		sh.Exec(`echo next $?`)
+		assert.Equal(t, "next 124\n", stdout.String())
+		assert.Equal(t, "", stderr.String())
+	}
+}
+
+func TestShellExecTimeoutLarge(t *testing.T) {
+	for _, script := range []string{
+		`echo ${big//` + strings.Repeat("?", 1000) + `c/x}; echo never`,
+		`switch $big; case ` + strings.Repeat("*a", 500) + `c; echo never; end`,
+		`cat` + strings.Repeat(" big", 1000) + ` > copy`,
+	} {
+		stderr := bytes.NewBuffer(nil)
+		sh := &Shell{
+			Err: stderr,
+		}
+		sh.Init()
+		big := strings.Repeat("ab", 1<<19)
+		sh.topLevel.Set("big", big)
+		w, _ := sh.FS.Create("big")
+		io.WriteString(w, big)
+
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		sh.ExecWithContext(ctx, script)
+		cancel()
+		assert.True(t, time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+		assert.Equal(t, "ghost: timeout\n", stderr.String())
+		assert.Equal(t, StatusTimeout, sh.Status())
+	}
+}
+
+func TestShellExecCanceled(t *testing.T) {
+	stderr := bytes.NewBuffer(nil)
+	sh := &Shell{
+		Err: stderr,
+	}
+	sh.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sh.ExecWithContext(ctx, `echo never`)
+	assert.Equal(t, "ghost: canceled\n", stderr.String())
+	assert.Equal(t, StatusCanceled, sh.Status())
+}
@@ -0,0 +1,114 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage keeps universal variables across restarts of the shell.
+type Storage interface {
+	// Load returns the stored variables.
+	Load() (*Environment, error)
+	// Save replaces the stored variables with the ones of env, not
+	// including the outer environments.
+	Save(env *Environment) error
+}
+
+// FileStorage is a Storage which keeps variables in a JSON file. A string
+// variable is stored as a JSON string and a list as an array of strings.
+// Whether a variable is readonly is not stored, since readonly universal
+// variables are pinned by the operator every time they are loaded. It is
+// safe for concurrent use.
+type FileStorage struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{
+		path: path,
+	}
+}
+
+// Load reads the variables from the file. A missing file has no variables.
+func (s *FileStorage) Load() (*Environment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	env := &Environment{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return env, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path, err)
+	}
+	for name, raw := range vars {
+		var val string
+		if err := json.Unmarshal(raw, &val); err == nil {
+			if err := env.Set(name, val); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("%s: %s: neither a string nor a list of strings", s.path, name)
+		}
+		if err := env.SetList(name, list); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// Save writes the variables to a temporary file and renames it to the file,
+// so that the file is never left half written.
+func (s *FileStorage) Save(env *Environment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	store, lists := env.snapshot()
+	vars := map[string]interface{}{}
+	for name, val := range store {
+		vars[name] = val
+	}
+	for name, list := range lists {
+		if list == nil {
+			list = []string{}
+		}
+		vars[name] = list
+	}
+	data, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
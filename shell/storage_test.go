@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "universal.json")
+
+	s := NewFileStorage(path)
+	env, err := s.Load()
+	assert.Nil(t, err)
+	assert.Empty(t, env.Names())
+
+	env.Set("x", "hello")
+	env.SetList("xs", []string{"a", "b c"})
+	env.SetList("empty", nil)
+	env.Pin("owner", "me")
+	env.SetList("admins", []string{"me"})
+	env.SetReadonly("admins")
+	assert.Nil(t, s.Save(env))
+
+	loaded, err := NewFileStorage(path).Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admins", "empty", "owner", "x", "xs"}, loaded.Names())
+	val, _ := loaded.Get("x")
+	assert.Equal(t, "hello", val)
+	list, _ := loaded.GetList("xs")
+	assert.Equal(t, []string{"a", "b c"}, list)
+	assert.True(t, loaded.IsList("empty"))
+	assert.False(t, loaded.IsReadonly("x"))
+	val, _ = loaded.Get("owner")
+	assert.Equal(t, "me", val)
+	assert.False(t, loaded.IsReadonly("owner"))
+	list, _ = loaded.GetList("admins")
+	assert.Equal(t, []string{"me"}, list)
+	assert.False(t, loaded.IsReadonly("admins"))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary files are left")
+
+	for _, data := range []string{`[]`, `{"x": 1}`, `{"x": [1]}`} {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+		_, err := s.Load()
+		assert.NotNil(t, err, "data=%s", data)
+	}
+}
@@ -0,0 +1,179 @@
+package shell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var testUnaryOperators = map[string]func(s string) bool{
+	"-z": func(s string) bool { return s == "" },
+	"-n": func(s string) bool { return s != "" },
+}
+
+var testBinaryOperators = map[string]func(x, y string) (bool, error){
+	"=":   func(x, y string) (bool, error) { return x == y, nil },
+	"==":  func(x, y string) (bool, error) { return x == y, nil },
+	"!=":  func(x, y string) (bool, error) { return x != y, nil },
+	"-eq": compareInt(func(x, y int64) bool { return x == y }),
+	"-ne": compareInt(func(x, y int64) bool { return x != y }),
+	"-lt": compareInt(func(x, y int64) bool { return x < y }),
+	"-le": compareInt(func(x, y int64) bool { return x <= y }),
+	"-gt": compareInt(func(x, y int64) bool { return x > y }),
+	"-ge": compareInt(func(x, y int64) bool { return x >= y }),
+}
+
+func compareInt(cmp func(x, y int64) bool) func(x, y string) (bool, error) {
+	return func(x, y string) (bool, error) {
+		a, err := parseTestInt(x)
+		if err != nil {
+			return false, err
+		}
+		b, err := parseTestInt(y)
+		if err != nil {
+			return false, err
+		}
+		return cmp(a, b), nil
+	}
+}
+
+func parseTestInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("integer expression expected: %q", s)
+	}
+	return n, nil
+}
+
+func testCmd(ctx *ExecContext, args []string) int {
+	return runTest(ctx, args[0], args[1:])
+}
+
+func bracket(ctx *ExecContext, args []string) int {
+	if args[len(args)-1] != "]" {
+		fmt.Fprintln(ctx.Stderr, "[: missing ]")
+		return 2
+	}
+	return runTest(ctx, args[0], args[1:len(args)-1])
+}
+
+// runTest evaluates a conditional expression. The status is 0 if the
+// expression is true, 1 if it is false and 2 if it is malformed.
+func runTest(ctx *ExecContext, name string, args []string) int {
+	ok, err := evalTest(args)
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr, "%s: %s\n", name, err)
+		return 2
+	}
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+func evalTest(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	t := &testParser{
+		args: args,
+	}
+	ok := t.parseOr()
+	if t.err == nil && t.pos < len(t.args) {
+		t.err = fmt.Errorf("unexpected argument %q", t.args[t.pos])
+	}
+	if t.err != nil {
+		return false, t.err
+	}
+	return ok, nil
+}
+
+// testParser is a recursive descent evaluator of the arguments of test.
+type testParser struct {
+	args []string
+	pos  int
+	err  error
+}
+
+func (t *testParser) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *testParser) peek(n int) (string, bool) {
+	if t.pos+n < len(t.args) {
+		return t.args[t.pos+n], true
+	}
+	return "", false
+}
+
+func (t *testParser) accept(op string) bool {
+	if arg, ok := t.peek(0); ok && arg == op {
+		t.pos++
+		return true
+	}
+	return false
+}
+
+func (t *testParser) parseOr() bool {
+	x := t.parseAnd()
+	for t.accept("-o") {
+		y := t.parseAnd()
+		x = x || y
+	}
+	return x
+}
+
+func (t *testParser) parseAnd() bool {
+	x := t.parseNot()
+	for t.accept("-a") {
+		y := t.parseNot()
+		x = x && y
+	}
+	return x
+}
+
+func (t *testParser) parseNot() bool {
+	// a lone "!" is a non-empty string
+	if _, ok := t.peek(1); ok && t.accept("!") {
+		return !t.parseNot()
+	}
+	return t.parsePrimary()
+}
+
+func (t *testParser) parsePrimary() bool {
+	arg, ok := t.peek(0)
+	if !ok {
+		t.fail(fmt.Errorf("argument expected"))
+		return false
+	}
+
+	if op, ok := t.peek(1); ok {
+		if cmp, isBinary := testBinaryOperators[op]; isBinary {
+			if y, ok := t.peek(2); ok {
+				t.pos += 3
+				result, err := cmp(arg, y)
+				if err != nil {
+					t.fail(err)
+				}
+				return result
+			}
+		}
+		if test, isUnary := testUnaryOperators[arg]; isUnary {
+			t.pos += 2
+			return test(op)
+		}
+		if arg == "(" {
+			t.pos++
+			x := t.parseOr()
+			if !t.accept(")") {
+				t.fail(fmt.Errorf("missing )"))
+			}
+			return x
+		}
+	}
+
+	t.pos++
+	return arg != ""
+}
@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalTest(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		expected bool
+		err      string
+	}{
+		{[]string{}, false, ""},
+		{[]string{"1"}, true, ""},
+		{[]string{""}, false, ""},
+		{[]string{"!"}, true, ""},
+		{[]string{"-n"}, true, ""},
+		{[]string{"-n", ""}, false, ""},
+		{[]string{"-z", ""}, true, ""},
+		{[]string{"a", "=", "a"}, true, ""},
+		{[]string{"a", "==", "b"}, false, ""},
+		{[]string{"a", "!=", "b"}, true, ""},
+		{[]string{"-n", "=", "-n"}, true, ""},
+		{[]string{"10", "-eq", "10"}, true, ""},
+		{[]string{"2", "-lt", "10"}, true, ""},
+		{[]string{"2", "-ge", "10"}, false, ""},
+		{[]string{"!", "1", "-gt", "2"}, true, ""},
+		{[]string{"a", "=", "a", "-a", "b", "=", "c"}, false, ""},
+		{[]string{"a", "=", "a", "-o", "b", "=", "c"}, true, ""},
+		{[]string{"a", "=", "b", "-o", "b", "=", "b", "-a", "", "=", "x"}, false, ""},
+		{[]string{"(", "a", "=", "b", "-o", "b", "=", "b", ")", "-a", "x"}, true, ""},
+		{[]string{"!", "(", "1", "-eq", "1", ")"}, false, ""},
+		{[]string{"a", "-eq", "1"}, false, `integer expression expected: "a"`},
+		{[]string{"(", "a"}, false, "missing )"},
+		{[]string{"a", "b"}, false, `unexpected argument "b"`},
+		{[]string{"a", "-a"}, false, "argument expected"},
+	} {
+		ok, err := evalTest(tt.args)
+		if tt.err != "" {
+			if assert.NotNil(t, err, "args=%q", tt.args) {
+				assert.Equal(t, tt.err, err.Error(), "args=%q", tt.args)
+			}
+			continue
+		}
+		assert.Nil(t, err, "args=%q", tt.args)
+		assert.Equal(t, tt.expected, ok, "args=%q", tt.args)
+	}
+}
@@ -13,12 +13,28 @@ const (
 	EOF    = -1
 	STRING = iota
 	TERMINATOR
+	PIPE
+	AND
+	OR
+	GREAT     // >
+	DGREAT    // >>
+	LESS      // <
+	DLESS     // <<
+	DLESSDASH // <<-
 )
 
 var tokens = map[TokenKind]string{
 	EOF:        "EOF",
 	STRING:     "STRING",
 	TERMINATOR: "TERMINATOR",
+	PIPE:       "PIPE",
+	AND:        "AND",
+	OR:         "OR",
+	GREAT:      "GREAT",
+	DGREAT:     "DGREAT",
+	LESS:       "LESS",
+	DLESS:      "DLESS",
+	DLESSDASH:  "DLESSDASH",
 }
 
 func (kind TokenKind) String() string {